@@ -0,0 +1,103 @@
+// Copyright 2025, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource/plugin"
+)
+
+const (
+	admissionAPIVersion = "admission.k8s.io/v1"
+	admissionKind       = "AdmissionReview"
+	// admissionOperation is the operation reported for every resource. The analyzer runs before a resource is
+	// created or updated and is not told which, so CREATE is used as the most conservative choice.
+	admissionOperation = "CREATE"
+)
+
+// translateAdmissionReview presents a Kubernetes resource the way the Kubernetes admission controller presents
+// it to OPA, so that rules written for a cluster run unchanged:
+//
+//	{
+//	    "apiVersion": "admission.k8s.io/v1",
+//	    "kind":       "AdmissionReview",
+//	    "request": {
+//	        "uid":       "<resource URN>",
+//	        "kind":      { "group": "apps", "version": "v1", "kind": "Deployment" },
+//	        "name":      "<metadata.name, or the Pulumi name>",
+//	        "namespace": "<metadata.namespace>",
+//	        "operation": "CREATE",
+//	        "object":    { "apiVersion": "apps/v1", "kind": "Deployment", "metadata": { ... }, ... }
+//	    },
+//	    "secrets":  [ "spec.template.spec.containers[0].env[0].value", ... ],
+//	    "unknowns": [ "metadata.name", ... ],
+//	    "options":  { "protect": false, ... },
+//	    "provider": { "urn": "...", "type": "pulumi:providers:kubernetes", ... }
+//	}
+//
+// The group, version and kind come from the object's apiVersion and kind when present, and from the Pulumi
+// type token (e.g. kubernetes:apps/v1:Deployment) otherwise.
+func translateAdmissionReview(c *propertyConverter, r plugin.AnalyzerResource) map[string]any {
+	props := c.convertProperties(r.Properties, r.Options.AdditionalSecretOutputs...)
+	object := props.values
+
+	// Work out the group/version/kind, preferring what the object says about itself.
+	apiVersion, _ := object["apiVersion"].(string)
+	kind, _ := object["kind"].(string)
+	if apiVersion == "" || apiVersion == unknownValue {
+		apiVersion = strings.TrimPrefix(string(r.Type.Module().Name()), "core/")
+	}
+	if kind == "" || kind == unknownValue {
+		kind = string(r.Type.Name())
+	}
+	group, version := "", apiVersion
+	if slash := strings.LastIndex(apiVersion, "/"); slash != -1 {
+		group, version = apiVersion[:slash], apiVersion[slash+1:]
+	}
+
+	// Prefer the Kubernetes name, which may differ from the Pulumi name through auto-naming or an explicit name.
+	name, namespace := r.Name, ""
+	if metadata, ok := object["metadata"].(map[string]any); ok {
+		if n, ok := metadata["name"].(string); ok && n != "" && n != unknownValue {
+			name = n
+		}
+		namespace, _ = metadata["namespace"].(string)
+	}
+
+	review := map[string]any{
+		"apiVersion": admissionAPIVersion,
+		"kind":       admissionKind,
+		"request": map[string]any{
+			"uid": string(r.URN),
+			"kind": map[string]any{
+				"group":   group,
+				"version": version,
+				"kind":    kind,
+			},
+			"name":      name,
+			"namespace": namespace,
+			"operation": admissionOperation,
+			"object":    object,
+		},
+		inputSecretsKey:  props.secrets,
+		inputUnknownsKey: props.unknowns,
+		inputOptionsKey:  newOptionsInput(r.Options),
+	}
+	if r.Provider != nil {
+		review[inputProviderKey] = newProviderInput(c, r.Provider)
+	}
+	return review
+}
@@ -16,10 +16,13 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"sort"
 
 	"github.com/blang/semver"
+	"github.com/pkg/errors"
 
-	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/resource/plugin"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/tokens"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
@@ -32,88 +35,212 @@ var VersionString = "0.0.1+dev"
 type analyzer struct {
 	pack *policyPack
 	e    *evaler
+
+	// ctx is the context evaluations run in, which Cancel cancels.
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 func NewAnalyzer(
 	pack *policyPack,
 	e *evaler,
 ) plugin.Analyzer {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &analyzer{
-		pack: pack,
-		e:    e,
+		pack:   pack,
+		e:      e,
+		ctx:    ctx,
+		cancel: cancel,
 	}
 }
 
+// evalContext returns a context for evaluating the pack against a resource or stack, which expires once the pack's
+// resource timeout has passed, if it has one, and is canceled by Cancel.
+func (a *analyzer) evalContext() (context.Context, context.CancelFunc) {
+	return withTimeout(a.ctx, a.pack.ResourceTimeout)
+}
+
 func (a *analyzer) Name() tokens.QName {
 	return tokens.QName(a.pack.Name)
 }
 
 func (a *analyzer) Analyze(r plugin.AnalyzerResource) (plugin.AnalyzeResponse, error) {
-	var diagnostics []plugin.AnalyzeDiagnostic
+	// Run the policy pack against this object, translated into the schema the pack's rules expect.
+	ctx, cancel := a.evalContext()
+	defer cancel()
+	obj, converter := newResourceInput(r, a.pack.Input)
+	results, err := a.e.evalPolicyPack(ctx, a.pack, resourcePolicy, obj, converter)
+	if err != nil {
+		return plugin.AnalyzeResponse{}, err
+	}
+
+	// Remediation rules that are not at the remediate level don't change the resource, but report that they would.
+	remediations, err := a.e.remediatePolicyPack(ctx, a.pack, r, false)
+	if err != nil {
+		return plugin.AnalyzeResponse{}, err
+	}
+	for _, remediation := range remediations {
+		result := evalPolicyResult{pack: remediation.pack, rule: remediation.rule, level: remediation.level}
+		if remediation.notApplicable != "" {
+			result.msg, result.deferred = remediation.notApplicable, true
+		} else {
+			result.msg = fmt.Sprintf("%s would remediate this resource", remediation.rule)
+		}
+		results = append(results, result)
+	}
+
+	return a.analyzeResponse(results, converter, r.URN, map[resource.URN]bool{r.URN: true})
+}
 
-	// Run the policy pack against this object's metadata.
-	// TODO: to attain rule compatibility with OPA rules written for, say, the Kubernetes Admission
-	//     Controller, there is a very different schema we would need to follow. It's possible we should
-	//     make the schema translation pluggable and customizable for certain policy packs and/or providers.
-	obj := r.Properties.Mappable()
-	results, err := a.e.evalPolicyPack(context.Background(), a.pack, obj)
+func (a *analyzer) AnalyzeStack(resources []plugin.AnalyzerStackResource) (plugin.AnalyzeResponse, error) {
+	// Run the stack rules once against the complete set of resources. Resource rules have already been
+	// run against each resource individually by Analyze, so there is no need to run them again here.
+	ctx, cancel := a.evalContext()
+	defer cancel()
+	obj, converter := newStackInput(resources, a.pack.Input)
+	results, err := a.e.evalPolicyPack(ctx, a.pack, stackPolicy, obj, converter)
 	if err != nil {
 		return plugin.AnalyzeResponse{}, err
 	}
 
-	// Translate the policy results into the appropriate analyzer data structures.
+	// Stack rules may attribute violations to any resource in the stack, and otherwise apply to the stack as a whole.
+	urns := make(map[resource.URN]bool)
+	for _, r := range resources {
+		urns[r.URN] = true
+	}
+	return a.analyzeResponse(results, converter, "", urns)
+}
+
+// analyzeResponse translates policy results into the appropriate analyzer data structures, scrubbing any secrets
+// the converter saw from their messages. Diagnostics are attributed to the URN the rule gave, which must be one of
+// urns, or to defaultURN if it gave none.
+func (a *analyzer) analyzeResponse(
+	results []evalPolicyResult,
+	converter *propertyConverter,
+	defaultURN resource.URN,
+	urns map[resource.URN]bool,
+) (plugin.AnalyzeResponse, error) {
+	var diagnostics []plugin.AnalyzeDiagnostic
+	var notApplicable []plugin.PolicyNotApplicable
 	for _, result := range results {
-		var level apitype.EnforcementLevel
-		if result.level == advisoryRule {
-			level = apitype.Advisory
-		} else {
-			level = apitype.Mandatory
+		if result.deferred {
+			notApplicable = append(notApplicable, plugin.PolicyNotApplicable{
+				PolicyName: result.rule,
+				Reason:     converter.redact(result.msg),
+			})
+			continue
+		}
+
+		urn := defaultURN
+		if result.urn != "" {
+			if !urns[result.urn] {
+				return plugin.AnalyzeResponse{}, errors.Errorf("rule %s.%s reported a violation for unknown resource %s",
+					result.pack, result.rule, result.urn)
+			}
+			urn = result.urn
 		}
+
+		// Rules at the remediate level that report violations rather than remediating have nothing to fix the
+		// violation with, so it is treated as mandatory.
+		level := result.level
+		if level == remediateRule {
+			level = mandatoryRule
+		}
+
 		diagnostics = append(diagnostics, plugin.AnalyzeDiagnostic{
 			PolicyName:        result.rule,
 			PolicyPackName:    result.pack,
-			PolicyPackVersion: VersionString,
-			Message:           result.msg,
-			URN:               r.URN,
-			EnforcementLevel:  level,
+			PolicyPackVersion: a.pack.version(),
+			Message:           converter.redact(result.msg),
+			Description:       converter.redact(result.description()),
+			URN:               urn,
+			EnforcementLevel:  level.apiType(),
+			Severity:          result.severity,
 		})
 	}
 
-	return plugin.AnalyzeResponse{Diagnostics: diagnostics}, nil
-}
-
-func (a *analyzer) AnalyzeStack(resources []plugin.AnalyzerStackResource) (plugin.AnalyzeResponse, error) {
-	// TODO: surface the complete set of resources to the OPA rule, perhaps as a different property.
-	//     We don't bother to re-run the rules here since we already analyzed all of them.
-	return plugin.AnalyzeResponse{}, nil
+	return plugin.AnalyzeResponse{Diagnostics: diagnostics, NotApplicable: notApplicable}, nil
 }
 
 func (a *analyzer) Remediate(r plugin.AnalyzerResource) (plugin.RemediateResponse, error) {
-	// OPA analyzer does not support remediation
-	return plugin.RemediateResponse{}, nil
+	ctx, cancel := a.evalContext()
+	defer cancel()
+	results, err := a.e.remediatePolicyPack(ctx, a.pack, r, true)
+	if err != nil {
+		return plugin.RemediateResponse{}, err
+	}
+
+	// Secrets in the resource may turn up in the reasons rules were not applicable, so scrub them.
+	_, converter := newResourceInput(r, a.pack.Input)
+
+	var remediations []plugin.Remediation
+	var notApplicable []plugin.PolicyNotApplicable
+	for _, result := range results {
+		if result.notApplicable != "" {
+			notApplicable = append(notApplicable, plugin.PolicyNotApplicable{
+				PolicyName: result.rule,
+				Reason:     converter.redact(result.notApplicable),
+			})
+			continue
+		}
+		remediations = append(remediations, plugin.Remediation{
+			PolicyName:        result.rule,
+			PolicyPackName:    result.pack,
+			PolicyPackVersion: a.pack.version(),
+			URN:               r.URN,
+			Properties:        result.properties,
+		})
+	}
+
+	return plugin.RemediateResponse{Remediations: remediations, NotApplicable: notApplicable}, nil
 }
 
 func (a *analyzer) GetAnalyzerInfo() (plugin.AnalyzerInfo, error) {
 	var policies []plugin.AnalyzerPolicyInfo
+	initialConfig := make(map[string]plugin.AnalyzerPolicyConfig)
 	for _, pol := range a.pack.Policies {
-		var enforcementLevel apitype.EnforcementLevel
-		if pol.Level == advisoryRule {
-			enforcementLevel = apitype.Advisory
-		} else {
-			enforcementLevel = apitype.Mandatory
+		policyType := plugin.AnalyzerPolicyTypeResource
+		if pol.Kind == stackPolicy {
+			policyType = plugin.AnalyzerPolicyTypeStack
+		}
+		var schema *plugin.AnalyzerPolicyConfigSchema
+		if pol.ConfigSchema != nil {
+			schema = pol.ConfigSchema.apiType()
+			initialConfig[pol.Name] = plugin.AnalyzerPolicyConfig{
+				EnforcementLevel: a.e.level(pol).apiType(),
+				Properties:       pol.defaultConfig(),
+			}
 		}
 		policies = append(policies, plugin.AnalyzerPolicyInfo{
 			Name:             pol.Name,
 			DisplayName:      pol.DisplayName,
 			Description:      pol.Description,
 			Message:          pol.Message,
-			EnforcementLevel: enforcementLevel,
+			EnforcementLevel: a.e.level(pol).apiType(),
+			Type:             policyType,
+			Severity:         pol.Severity,
+			ConfigSchema:     schema,
+			Framework:        pol.Compliance.framework(),
+			Tags:             pol.Compliance.tags(),
 		})
 	}
+	var coverage []string
+	for tag := range a.pack.coverage() {
+		coverage = append(coverage, tag)
+	}
+	sort.Strings(coverage)
+
 	return plugin.AnalyzerInfo{
-		Name:        a.pack.Name,
-		DisplayName: a.pack.DisplayName,
-		Policies:    policies,
+		Name:           a.pack.Name,
+		DisplayName:    a.pack.DisplayName,
+		Version:        a.pack.version(),
+		Description:    a.pack.Description,
+		Policies:       policies,
+		SupportsConfig: true,
+		InitialConfig:  initialConfig,
+		// Tag the pack with its content hash, so that audits can tell exactly which rules ran, and with the
+		// compliance controls its rules cover.
+		Tags: append([]string{"sha256:" + a.pack.Hash}, coverage...),
 	}, nil
 }
 
@@ -128,12 +255,12 @@ func (a *analyzer) GetPluginInfo() (workspace.PluginInfo, error) {
 }
 
 func (a *analyzer) Configure(policyConfig map[string]plugin.AnalyzerPolicyConfig) error {
-	// No configuration needed for now
-	return nil
+	return a.e.configure(a.pack, policyConfig)
 }
 
+// Cancel aborts any evaluations under way, and any started afterwards, which fail with an error.
 func (a *analyzer) Cancel(ctx context.Context) error {
-	// No cancellation needed
+	a.cancel()
 	return nil
 }
 
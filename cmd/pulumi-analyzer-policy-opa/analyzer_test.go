@@ -0,0 +1,1931 @@
+// Copyright 2025, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/open-policy-agent/opa/v1/ast"
+	"github.com/open-policy-agent/opa/v1/rego"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource/plugin"
+)
+
+// writePack lays out a policy pack in a temporary directory, mapping relative paths to file contents.
+func writePack(t testing.TB, files map[string]string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("creating %s: %v", filepath.Dir(path), err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatalf("writing %s: %v", path, err)
+		}
+	}
+	return dir
+}
+
+// newTestAnalyzer loads the pack in dir and wraps it in an analyzer.
+func newTestAnalyzer(t testing.TB, dir string) plugin.Analyzer {
+	t.Helper()
+
+	pack, e, err := loadPolicyPack(dir)
+	if err != nil {
+		t.Fatalf("loading policy pack: %v", err)
+	}
+	return NewAnalyzer(pack, e)
+}
+
+// testBucket returns an S3 bucket resource with the given properties.
+func testBucket(props map[string]any) plugin.AnalyzerResource {
+	return plugin.AnalyzerResource{
+		URN:        resource.URN("urn:pulumi:dev::app::aws:s3/bucket:Bucket::my-bucket"),
+		Type:       "aws:s3/bucket:Bucket",
+		Name:       "my-bucket",
+		Properties: resource.NewPropertyMapFromMap(props),
+	}
+}
+
+// messages returns the sorted diagnostic messages from an analysis.
+func messages(t *testing.T, resp plugin.AnalyzeResponse, err error) []string {
+	t.Helper()
+
+	if err != nil {
+		t.Fatalf("analyzing: %v", err)
+	}
+	var msgs []string
+	for _, d := range resp.Diagnostics {
+		msgs = append(msgs, d.Message)
+	}
+	sort.Strings(msgs)
+	return msgs
+}
+
+func assertMessages(t *testing.T, got []string, want ...string) {
+	t.Helper()
+
+	sort.Strings(want)
+	if len(got) != len(want) {
+		t.Fatalf("expected messages %q, got %q", want, got)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("expected messages %q, got %q", want, got)
+		}
+	}
+}
+
+func TestAnalyzeResourceInput(t *testing.T) {
+	dir := writePack(t, map[string]string{
+		"PulumiPolicy.yaml": "runtime: opa\n",
+		"s3.rego": `package aws
+
+deny[msg] {
+    input.type == "aws:s3/bucket:Bucket"
+    input.properties.acl == "public-read"
+    msg := sprintf("%s (%s) is public", [input.name, input.urn])
+}
+`,
+	})
+	a := newTestAnalyzer(t, dir)
+
+	resp, err := a.Analyze(testBucket(map[string]any{"acl": "public-read"}))
+	assertMessages(t, messages(t, resp, err),
+		"my-bucket (urn:pulumi:dev::app::aws:s3/bucket:Bucket::my-bucket) is public")
+
+	resp, err = a.Analyze(testBucket(map[string]any{"acl": "private"}))
+	assertMessages(t, messages(t, resp, err))
+}
+
+func TestAnalyzePropertiesInput(t *testing.T) {
+	dir := writePack(t, map[string]string{
+		"PulumiPolicy.yaml": "runtime: opa\ninput:\n  format: properties\n",
+		"s3.rego": `package aws
+
+deny[msg] {
+    input.type == "aws:s3/bucket:Bucket"
+    input.acl == "public-read"
+    msg := sprintf("%s (%s) is public", [input.__name, input.__urn])
+}
+`,
+	})
+	a := newTestAnalyzer(t, dir)
+
+	resp, err := a.Analyze(testBucket(map[string]any{"acl": "public-read", "type": "shadowed"}))
+	assertMessages(t, messages(t, resp, err),
+		"my-bucket (urn:pulumi:dev::app::aws:s3/bucket:Bucket::my-bucket) is public")
+}
+
+func TestLoadRejectsBarePropertiesWithoutFormat(t *testing.T) {
+	rules := "package aws\n\ndeny[msg] {\n    input.acl == \"public-read\"\n    msg := \"public\"\n}\n"
+	dir := writePack(t, map[string]string{"s3.rego": rules})
+	if _, _, err := loadPolicyPack(dir); err == nil || !strings.Contains(err.Error(), "reads input.acl") {
+		t.Fatalf("expected an error for a rule reading bare properties, got %v", err)
+	}
+
+	// Choosing the properties format makes the rule work as it was written.
+	dir = writePack(t, map[string]string{
+		"PulumiPolicy.yaml": "input:\n  format: properties\n",
+		"s3.rego":           rules,
+	})
+	resp, err := newTestAnalyzer(t, dir).Analyze(testBucket(map[string]any{"acl": "public-read"}))
+	assertMessages(t, messages(t, resp, err), "public")
+}
+
+func TestLoadManifestRejectsUnknownInputFormat(t *testing.T) {
+	dir := writePack(t, map[string]string{
+		"PulumiPolicy.yaml": "runtime: opa\ninput:\n  format: flat\n",
+		"s3.rego":           "package aws\n",
+	})
+	if _, _, err := loadPolicyPack(dir); err == nil {
+		t.Fatalf("expected an error for an unknown input format")
+	}
+}
+
+func TestAnalyzeKubernetesAdmissionInput(t *testing.T) {
+	dir := writePack(t, map[string]string{
+		"PulumiPolicy.yaml": "runtime: opa\ninput:\n  providers:\n    kubernetes: kubernetes-admission\n",
+		"k8s.rego": `package kubernetes
+
+deny[msg] {
+    input.request.kind.kind == "Pod"
+    input.request.operation == "CREATE"
+    image := input.request.object.spec.containers[_].image
+    not startswith(image, "hooli.com/")
+    msg := sprintf("%s/%s (%s/%s): image '%v' comes from untrusted registry", [
+        input.request.namespace, input.request.name,
+        input.request.kind.group, input.request.kind.version, image])
+}
+
+deny[msg] {
+    input.type == "aws:s3/bucket:Bucket"
+    msg := "not a kubernetes resource"
+}
+`,
+	})
+	a := newTestAnalyzer(t, dir)
+
+	pod := plugin.AnalyzerResource{
+		URN:  resource.URN("urn:pulumi:dev::app::kubernetes:core/v1:Pod::web"),
+		Type: "kubernetes:core/v1:Pod",
+		Name: "web",
+		Properties: resource.NewPropertyMapFromMap(map[string]any{
+			"metadata": map[string]any{"name": "web-1234", "namespace": "prod"},
+			"spec": map[string]any{
+				"containers": []any{map[string]any{"image": "nginx"}},
+			},
+		}),
+	}
+	resp, err := a.Analyze(pod)
+	assertMessages(t, messages(t, resp, err),
+		"prod/web-1234 (/v1): image 'nginx' comes from untrusted registry")
+
+	// Resources from other providers keep the pack's default format.
+	resp, err = a.Analyze(testBucket(nil))
+	assertMessages(t, messages(t, resp, err), "not a kubernetes resource")
+}
+
+func TestAnalyzeResourceOptions(t *testing.T) {
+	dir := writePack(t, map[string]string{
+		"PulumiPolicy.yaml": "runtime: opa\n",
+		"options.rego": `package aws
+
+import future.keywords.in
+
+deny[msg] {
+    not input.options.protect
+    msg := "unprotected"
+}
+
+deny[msg] {
+    some path in input.options.ignoreChanges
+    startswith(path, "tags")
+    msg := sprintf("ignores %s", [path])
+}
+
+deny[msg] {
+    input.options.deleteBeforeReplace
+    input.options.customTimeouts.delete > 60
+    msg := sprintf("slow delete under %s aliased from %v", [input.options.parent, input.options.aliases])
+}
+`,
+	})
+	a := newTestAnalyzer(t, dir)
+
+	bucket := testBucket(nil)
+	resp, err := a.Analyze(bucket)
+	assertMessages(t, messages(t, resp, err), "unprotected")
+
+	dbr := true
+	bucket.Options = plugin.AnalyzerResourceOptions{
+		Protect:             true,
+		IgnoreChanges:       []string{"tags.owner", "acl"},
+		DeleteBeforeReplace: &dbr,
+		AliasURNs:           []resource.URN{"urn:pulumi:dev::app::aws:s3/bucket:Bucket::old"},
+		CustomTimeouts:      resource.CustomTimeouts{Delete: 120},
+		Parent:              "urn:pulumi:dev::app::pulumi:pulumi:Stack::app-dev",
+	}
+	resp, err = a.Analyze(bucket)
+	assertMessages(t, messages(t, resp, err),
+		"ignores tags.owner",
+		`slow delete under urn:pulumi:dev::app::pulumi:pulumi:Stack::app-dev aliased from `+
+			`["urn:pulumi:dev::app::aws:s3/bucket:Bucket::old"]`)
+}
+
+func TestAnalyzeProvider(t *testing.T) {
+	dir := writePack(t, map[string]string{
+		"PulumiPolicy.yaml": "runtime: opa\n",
+		"provider.rego": `package aws
+
+deny[msg] {
+    input.provider.properties.region != "eu-west-1"
+    msg := sprintf("%s is in %s", [input.name, input.provider.properties.region])
+}
+
+deny[msg] {
+    input.provider.default
+    msg := sprintf("%s uses the default provider", [input.name])
+}
+
+deny[msg] {
+    not input.provider
+    msg := sprintf("%s has no provider", [input.name])
+}
+`,
+	})
+	a := newTestAnalyzer(t, dir)
+
+	bucket := testBucket(nil)
+	resp, err := a.Analyze(bucket)
+	assertMessages(t, messages(t, resp, err), "my-bucket has no provider")
+
+	bucket.Provider = &plugin.AnalyzerProviderResource{
+		URN:        "urn:pulumi:dev::app::pulumi:providers:aws::default_6_0_0",
+		Type:       "pulumi:providers:aws",
+		Name:       "default_6_0_0",
+		Properties: resource.NewPropertyMapFromMap(map[string]any{"region": "us-east-1"}),
+	}
+	resp, err = a.Analyze(bucket)
+	assertMessages(t, messages(t, resp, err),
+		"my-bucket is in us-east-1", "my-bucket uses the default provider")
+
+	bucket.Provider = &plugin.AnalyzerProviderResource{
+		URN:        "urn:pulumi:dev::app::pulumi:providers:aws::eu",
+		Type:       "pulumi:providers:aws",
+		Name:       "eu",
+		Properties: resource.NewPropertyMapFromMap(map[string]any{"region": "eu-west-1"}),
+	}
+	resp, err = a.Analyze(bucket)
+	assertMessages(t, messages(t, resp, err))
+}
+
+func TestAnalyzeSecrets(t *testing.T) {
+	dir := writePack(t, map[string]string{
+		"PulumiPolicy.yaml": "runtime: opa\n",
+		"secrets.rego": `package aws
+
+deny[msg] {
+    msg := sprintf("secrets at %v", [input.secrets])
+}
+
+deny[msg] {
+    count(input.properties.password) < 16
+    msg := sprintf("password '%s' is too short", [input.properties.password])
+}
+
+deny[msg] {
+    msg := sprintf("tags: %v", [input.properties.tags])
+}
+`,
+	})
+	a := newTestAnalyzer(t, dir)
+
+	bucket := testBucket(nil)
+	bucket.Properties = resource.PropertyMap{
+		"password": resource.MakeSecret(resource.NewStringProperty("hunter2")),
+		"tags": resource.NewObjectProperty(resource.PropertyMap{
+			"owner":   resource.NewStringProperty("platform"),
+			"api-key": resource.MakeSecret(resource.NewStringProperty(`k"ey`)),
+		}),
+		"token": resource.NewStringProperty("opaque"),
+	}
+	bucket.Options.AdditionalSecretOutputs = []resource.PropertyKey{"token"}
+
+	resp, err := a.Analyze(bucket)
+	assertMessages(t, messages(t, resp, err),
+		`secrets at ["password", "tags[\"api-key\"]", "token"]`,
+		"password '[secret]' is too short",
+		`tags: {"api-key": "[secret]", "owner": "platform"}`)
+}
+
+func TestAnalyzeSecretScalars(t *testing.T) {
+	dir := writePack(t, map[string]string{
+		"s3.rego": `package aws
+
+deny[msg] {
+    msg := sprintf("port %v, pin %d, pinned %v, size %v", [
+        input.properties.port, input.properties.pin, input.properties.pinned, input.properties.size])
+}
+`,
+	})
+	bucket := testBucket(nil)
+	bucket.Properties = resource.PropertyMap{
+		"port":   resource.MakeSecret(resource.NewNumberProperty(8443)),
+		"pin":    resource.MakeSecret(resource.NewNumberProperty(12)),
+		"pinned": resource.MakeSecret(resource.NewBoolProperty(true)),
+		"size":   resource.NewNumberProperty(1208443),
+	}
+
+	// Secret numbers and bools are scrubbed where they stand alone, but not from within other numbers.
+	resp, err := newTestAnalyzer(t, dir).Analyze(bucket)
+	assertMessages(t, messages(t, resp, err), "port [secret], pin [secret], pinned [secret], size 1208443")
+}
+
+func TestAnalyzeUnknowns(t *testing.T) {
+	dir := writePack(t, map[string]string{
+		"PulumiPolicy.yaml": `runtime: opa
+unknowns: skip
+rules:
+  unknowns.rego:aws.deny_acl:
+    unknowns: fail
+  unknowns.rego:aws.deny_tags:
+    unknowns: defer
+  unknowns.rego:aws.deny_unknown:
+    unknowns: evaluate
+`,
+		"unknowns.rego": `package aws
+
+deny_acl[msg] {
+    input.properties.acl == "public-read"
+    msg := "public"
+}
+
+deny_tags[msg] {
+    not is_tagged
+    msg := "untagged"
+}
+
+is_tagged {
+    input.properties.tags.owner
+}
+
+warn_arn[msg] {
+    msg := sprintf("arn is %s", [input.properties.arn])
+}
+
+deny_unknown[msg] {
+    pulumi.is_unknown(input.properties.arn)
+    pulumi.has_unknowns(input.properties)
+    not pulumi.is_unknown(input.properties.tags)
+    msg := sprintf("unknowns at %v", [input.unknowns])
+}
+`,
+	})
+	a := newTestAnalyzer(t, dir)
+
+	bucket := testBucket(nil)
+	bucket.Properties = resource.PropertyMap{
+		"acl": resource.MakeComputed(resource.NewStringProperty("")),
+		"arn": resource.NewOutputProperty(resource.Output{Element: resource.NewStringProperty("")}),
+		"tags": resource.NewObjectProperty(resource.PropertyMap{
+			"team": resource.NewStringProperty("platform"),
+		}),
+	}
+	resp, err := a.Analyze(bucket)
+	assertMessages(t, messages(t, resp, err),
+		"unknowns.rego:aws.deny_acl cannot be evaluated because input.properties.acl is not known yet",
+		`unknowns at ["acl", "arn"]`,
+		"untagged")
+	if len(resp.NotApplicable) != 0 {
+		t.Fatalf("expected no deferred rules, got %v", resp.NotApplicable)
+	}
+
+	bucket.Properties["tags"] = resource.MakeComputed(resource.NewStringProperty(""))
+	resp, err = a.Analyze(bucket)
+	assertMessages(t, messages(t, resp, err),
+		"unknowns.rego:aws.deny_acl cannot be evaluated because input.properties.acl is not known yet")
+	if len(resp.NotApplicable) != 1 || resp.NotApplicable[0].PolicyName != "unknowns.rego:aws.deny_tags" {
+		t.Fatalf("expected deny_tags to be deferred, got %v", resp.NotApplicable)
+	}
+}
+
+func TestLoadManifestRejectsSettingsForUnknownRules(t *testing.T) {
+	dir := writePack(t, map[string]string{
+		"PulumiPolicy.yaml": "runtime: opa\nrules:\n  deny_nothing:\n    unknowns: skip\n",
+		"s3.rego":           "package aws\n\ndeny[msg] {\n    msg := \"x\"\n}\n",
+	})
+	if _, _, err := loadPolicyPack(dir); err == nil {
+		t.Fatalf("expected an error for settings given to an unknown rule")
+	}
+}
+
+// testStack returns a stack with two buckets, only the first of which has a public access block.
+func testStack() []plugin.AnalyzerStackResource {
+	bucket := func(name string) plugin.AnalyzerStackResource {
+		return plugin.AnalyzerStackResource{AnalyzerResource: plugin.AnalyzerResource{
+			URN:  resource.URN("urn:pulumi:dev::app::aws:s3/bucket:Bucket::" + name),
+			Type: "aws:s3/bucket:Bucket",
+			Name: name,
+			Properties: resource.NewPropertyMapFromMap(map[string]any{
+				"bucket": name,
+			}),
+		}}
+	}
+	block := plugin.AnalyzerStackResource{AnalyzerResource: plugin.AnalyzerResource{
+		URN:  "urn:pulumi:dev::app::aws:s3/bucketPublicAccessBlock:BucketPublicAccessBlock::logs",
+		Type: "aws:s3/bucketPublicAccessBlock:BucketPublicAccessBlock",
+		Name: "logs",
+		Properties: resource.NewPropertyMapFromMap(map[string]any{
+			"bucket": "logs",
+		}),
+	}}
+	return []plugin.AnalyzerStackResource{bucket("logs"), bucket("data"), block}
+}
+
+func TestAnalyzeStack(t *testing.T) {
+	dir := writePack(t, map[string]string{
+		"PulumiPolicy.yaml": "runtime: opa\n",
+		"stack.rego": `package aws
+
+import future.keywords.in
+
+deny_stack[msg] {
+    some bucket in input.resources
+    bucket.type == "aws:s3/bucket:Bucket"
+    not has_access_block(bucket.properties.bucket)
+    msg := sprintf("bucket %s has no public access block", [bucket.name])
+}
+
+has_access_block(name) {
+    some block in input.resources
+    block.type == "aws:s3/bucketPublicAccessBlock:BucketPublicAccessBlock"
+    block.properties.bucket == name
+}
+
+warn_stack[msg] {
+    msg := sprintf("%d resources", [count(input.resources)])
+}
+
+deny[msg] {
+    msg := sprintf("resource %s", [input.name])
+}
+`,
+	})
+	a := newTestAnalyzer(t, dir)
+
+	// Stack rules only run against the stack, and resource rules only against resources.
+	resp, err := a.AnalyzeStack(testStack())
+	assertMessages(t, messages(t, resp, err), "bucket data has no public access block", "3 resources")
+	for _, d := range resp.Diagnostics {
+		if d.URN != "" {
+			t.Fatalf("expected stack diagnostics to have no URN, got %s", d.URN)
+		}
+	}
+
+	resp, err = a.Analyze(testBucket(nil))
+	assertMessages(t, messages(t, resp, err), "resource my-bucket")
+
+	info, err := a.GetAnalyzerInfo()
+	if err != nil {
+		t.Fatalf("getting analyzer info: %v", err)
+	}
+	for _, p := range info.Policies {
+		want := plugin.AnalyzerPolicyTypeStack
+		if p.Name == "stack.rego:aws.deny" {
+			want = plugin.AnalyzerPolicyTypeResource
+		}
+		if p.Type != want {
+			t.Errorf("expected policy %s to have type %v, got %v", p.Name, want, p.Type)
+		}
+	}
+}
+
+func TestAnalyzeStackGraph(t *testing.T) {
+	dir := writePack(t, map[string]string{
+		"PulumiPolicy.yaml": "runtime: opa\n",
+		"graph.rego": `package aws
+
+import future.keywords.in
+
+warn_stack[msg] {
+    some urn, node in input.graph
+    count(node.children) > 0
+    msg := sprintf("%s has children %v", [urn, node.children])
+}
+
+warn_stack[msg] {
+    some urn, node in input.graph
+    count(node.propertyDependencies) > 0
+    msg := sprintf("%s depends on %v", [urn, node.propertyDependencies])
+}
+
+warn_stack[msg] {
+    some r in input.resources
+    r.name == "logs"
+    r.type == "aws:s3/bucketPublicAccessBlock:BucketPublicAccessBlock"
+    msg := sprintf("ancestors %v", [pulumi.graph.ancestors(input.graph, r.urn)])
+}
+
+warn_stack[msg] {
+    msg := sprintf("dependents %v", [pulumi.graph.dependents(input.graph, "urn:pulumi:dev::app::my:index:Component$aws:s3/bucket:Bucket::logs")])
+}
+
+warn_stack[msg] {
+    msg := sprintf("reachable %v", [pulumi.graph.reachable(input.graph, "urn:pulumi:dev::app::aws:s3/bucket:Bucket::data")])
+}
+`,
+	})
+	a := newTestAnalyzer(t, dir)
+
+	const (
+		component = "urn:pulumi:dev::app::my:index:Component::app"
+		logs      = "urn:pulumi:dev::app::my:index:Component$aws:s3/bucket:Bucket::logs"
+		block     = "urn:pulumi:dev::app::aws:s3/bucketPublicAccessBlock:BucketPublicAccessBlock::logs"
+	)
+	stack := testStack()
+	stack = append([]plugin.AnalyzerStackResource{{AnalyzerResource: plugin.AnalyzerResource{
+		URN:  component,
+		Type: "my:index:Component",
+		Name: "app",
+	}}}, stack...)
+	stack[1].URN, stack[1].Parent = logs, component
+	stack[3].Parent = logs
+	stack[3].PropertyDependencies = map[resource.PropertyKey][]resource.URN{"bucket": {logs}}
+
+	resp, err := a.AnalyzeStack(stack)
+	assertMessages(t, messages(t, resp, err),
+		"ancestors {\""+logs+"\", \""+component+"\"}",
+		"dependents {\""+block+"\"}",
+		"reachable set()",
+		block+" depends on {\"bucket\": [\""+logs+"\"]}",
+		component+" has children [\""+logs+"\"]",
+		logs+" has children [\""+block+"\"]",
+	)
+}
+
+func TestAnalyzeStackAttributesViolations(t *testing.T) {
+	dir := writePack(t, map[string]string{
+		"PulumiPolicy.yaml": "runtime: opa\n",
+		"stack.rego": `package aws
+
+import future.keywords.in
+
+deny_stack[violation] {
+    some bucket in input.resources
+    bucket.type == "aws:s3/bucket:Bucket"
+    violation := {"msg": sprintf("bucket %s is unencrypted", [bucket.name]), "urn": bucket.urn}
+}
+
+warn_stack[violation] {
+    violation := {"msg": "stack-wide"}
+}
+
+warn_stack_bogus[violation] {
+    input.resources[_].name == "bogus"
+    violation := {"msg": "bogus", "urn": "urn:pulumi:dev::app::aws:s3/bucket:Bucket::missing"}
+}
+`,
+	})
+	a := newTestAnalyzer(t, dir)
+
+	resp, err := a.AnalyzeStack(testStack())
+	assertMessages(t, messages(t, resp, err), "bucket data is unencrypted", "bucket logs is unencrypted", "stack-wide")
+	attributed := map[string]resource.URN{
+		"bucket data is unencrypted": "urn:pulumi:dev::app::aws:s3/bucket:Bucket::data",
+		"bucket logs is unencrypted": "urn:pulumi:dev::app::aws:s3/bucket:Bucket::logs",
+		"stack-wide":                 "",
+	}
+	for _, d := range resp.Diagnostics {
+		if want := attributed[d.Message]; d.URN != want {
+			t.Errorf("expected %q to be attributed to %q, got %q", d.Message, want, d.URN)
+		}
+	}
+
+	// Violations may only be attributed to resources in the stack.
+	stack := append(testStack(), plugin.AnalyzerStackResource{AnalyzerResource: plugin.AnalyzerResource{
+		URN:  "urn:pulumi:dev::app::aws:s3/bucket:Bucket::bogus",
+		Type: "aws:s3/bucket:Bucket",
+		Name: "bogus",
+	}})
+	if _, err := a.AnalyzeStack(stack); err == nil {
+		t.Fatal("expected an error for a violation attributed to a resource outside the stack")
+	}
+}
+
+func TestRemediate(t *testing.T) {
+	dir := writePack(t, map[string]string{
+		"PulumiPolicy.yaml": "runtime: opa\n",
+		"remediate.rego": `package aws
+
+# Replaces the properties outright.
+remediate_acl = props {
+    input.properties.acl == "public-read"
+    props := object.union(input.properties, {"acl": "private"})
+}
+
+# Patches the properties, seeing the ACL as already fixed.
+remediate_tags = [{"op": "add", "path": "/tags/acl", "value": input.properties.acl}] {
+    not input.properties.tags.acl
+}
+
+# Leaves the properties as they are.
+remediate_noop = input.properties
+
+deny[msg] {
+    msg := "not run by Remediate"
+}
+`,
+	})
+	a := newTestAnalyzer(t, dir)
+
+	bucket := testBucket(map[string]any{"acl": "public-read", "tags": map[string]any{}, "size": 10})
+	bucket.Properties["password"] = resource.MakeSecret(resource.NewStringProperty("hunter2"))
+
+	resp, err := a.Remediate(bucket)
+	if err != nil {
+		t.Fatalf("remediating: %v", err)
+	}
+	if len(resp.Remediations) != 2 {
+		t.Fatalf("expected 2 remediations, got %v", resp.Remediations)
+	}
+
+	acl, tags := resp.Remediations[0], resp.Remediations[1]
+	if acl.PolicyName != "remediate.rego:aws.remediate_acl" || tags.PolicyName != "remediate.rego:aws.remediate_tags" {
+		t.Fatalf("expected remediations in rule order, got %s then %s", acl.PolicyName, tags.PolicyName)
+	}
+	if acl.URN != bucket.URN {
+		t.Errorf("expected remediation for %s, got %s", bucket.URN, acl.URN)
+	}
+
+	want := resource.PropertyMap{
+		"acl":      resource.NewStringProperty("private"),
+		"tags":     resource.NewObjectProperty(resource.PropertyMap{"acl": resource.NewStringProperty("private")}),
+		"size":     resource.NewNumberProperty(10),
+		"password": resource.MakeSecret(resource.NewStringProperty("hunter2")),
+	}
+	if !tags.Properties.DeepEquals(want) {
+		t.Errorf("expected remediated properties %v, got %v", want, tags.Properties)
+	}
+
+	info, err := a.GetAnalyzerInfo()
+	if err != nil {
+		t.Fatalf("getting analyzer info: %v", err)
+	}
+	for _, p := range info.Policies {
+		if p.Name != "remediate.rego:aws.deny" && p.EnforcementLevel != apitype.Remediate {
+			t.Errorf("expected policy %s to remediate, got %s", p.Name, p.EnforcementLevel)
+		}
+	}
+}
+
+func TestRemediateInputFormats(t *testing.T) {
+	pod := plugin.AnalyzerResource{
+		URN:  resource.URN("urn:pulumi:dev::app::kubernetes:core/v1:Pod::web"),
+		Type: "kubernetes:core/v1:Pod",
+		Name: "web",
+		Properties: resource.NewPropertyMapFromMap(map[string]any{
+			"metadata": map[string]any{"name": "web"},
+			"type":     "frontend",
+		}),
+	}
+	withProvider := testBucket(map[string]any{"acl": "public-read"})
+	withProvider.Provider = &plugin.AnalyzerProviderResource{
+		URN:  resource.URN("urn:pulumi:dev::app::pulumi:providers:aws::default"),
+		Type: "pulumi:providers:aws",
+		Name: "default",
+	}
+
+	for _, tt := range []struct {
+		name     string
+		manifest string
+		rules    string
+		resource plugin.AnalyzerResource
+		want     map[string]any
+	}{
+		{
+			name:     "resource",
+			manifest: "runtime: opa\n",
+			rules: `remediate_acl = object.union(input.properties, {"acl": "private"})
+remediate_tags = [{"op": "add", "path": "/tags", "value": {"owner": input.name}}]`,
+			resource: testBucket(map[string]any{"acl": "public-read"}),
+			want:     map[string]any{"acl": "private", "tags": map[string]any{"owner": "my-bucket"}},
+		},
+		{
+			name:     "properties",
+			manifest: "input:\n  format: properties\n",
+			rules: `remediate_acl = object.union(input, {"acl": "private"})
+remediate_tags = [{"op": "add", "path": "/tags", "value": {"owner": input.__name}}]`,
+			resource: withProvider,
+			want:     map[string]any{"acl": "private", "tags": map[string]any{"owner": "my-bucket"}},
+		},
+		{
+			// The pod has a real property named like a reserved key, which is hidden from rules but kept.
+			name:     "properties with a hidden property",
+			manifest: "input:\n  format: properties\n",
+			rules:    `remediate_labels = object.union(input, {"metadata": {"name": "web", "labels": {"app": "web"}}})`,
+			resource: pod,
+			want: map[string]any{
+				"metadata": map[string]any{"name": "web", "labels": map[string]any{"app": "web"}},
+				"type":     "frontend",
+			},
+		},
+		{
+			name:     "kubernetes-admission",
+			manifest: "input:\n  format: kubernetes-admission\n",
+			rules: `remediate_labels = object.union(input.request.object, {"metadata": {"name": "web", "labels": {}}})
+remediate_app = [{"op": "add", "path": "/metadata/labels/app", "value": input.request.name}]`,
+			resource: pod,
+			want: map[string]any{
+				"metadata": map[string]any{"name": "web", "labels": map[string]any{"app": "web"}},
+				"type":     "frontend",
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writePack(t, map[string]string{
+				"PulumiPolicy.yaml": tt.manifest,
+				"remediate.rego":    "package aws\n\n" + tt.rules + "\n",
+			})
+			resp, err := newTestAnalyzer(t, dir).Remediate(tt.resource)
+			if err != nil {
+				t.Fatalf("remediating: %v", err)
+			}
+			if len(resp.Remediations) == 0 {
+				t.Fatalf("expected remediations, got none")
+			}
+			got := resp.Remediations[len(resp.Remediations)-1].Properties
+			if want := resource.NewPropertyMapFromMap(tt.want); !got.DeepEquals(want) {
+				t.Errorf("expected remediated properties %v, got %v", want, got)
+			}
+		})
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	dir := writePack(t, map[string]string{
+		"PulumiPolicy.yaml": "runtime: opa\n",
+		"config.rego": `package aws
+
+deny_size[msg] {
+    input.properties.size > data.pulumi.config["config.rego:aws.deny_size"].max
+    msg := sprintf("size %v exceeds %v", [input.properties.size, data.pulumi.config["config.rego:aws.deny_size"].max])
+}
+
+warn_config[msg] {
+    msg := sprintf("config %v", [data.pulumi.config["config.rego:aws.warn_config"]])
+}
+`,
+	})
+	a := newTestAnalyzer(t, dir)
+	bucket := testBucket(map[string]any{"size": 10})
+
+	// Rules without configuration see an empty object.
+	resp, err := a.Analyze(bucket)
+	assertMessages(t, messages(t, resp, err), "config {}")
+
+	err = a.Configure(map[string]plugin.AnalyzerPolicyConfig{
+		"config.rego:aws.deny_size": {
+			EnforcementLevel: apitype.Advisory,
+			Properties:       map[string]any{"max": 5},
+		},
+	})
+	if err != nil {
+		t.Fatalf("configuring: %v", err)
+	}
+	resp, err = a.Analyze(bucket)
+	assertMessages(t, messages(t, resp, err), "config {}", "size 10 exceeds 5")
+	for _, d := range resp.Diagnostics {
+		if d.EnforcementLevel != apitype.Advisory {
+			t.Errorf("expected %q to be advisory, got %s", d.Message, d.EnforcementLevel)
+		}
+	}
+
+	if err := a.Configure(map[string]plugin.AnalyzerPolicyConfig{"config.rego:aws.deny_missing": {}}); err == nil {
+		t.Fatal("expected an error configuring an unknown rule")
+	}
+}
+
+func TestConfigSchema(t *testing.T) {
+	dir := writePack(t, map[string]string{
+		"PulumiPolicy.yaml": `runtime: opa
+rules:
+  config.rego:aws.warn_tags:
+    config:
+      properties:
+        required:
+          type: array
+          items: {type: string}
+`,
+		"config.rego": `package aws
+
+import future.keywords.in
+
+# METADATA
+# custom:
+#   config:
+#     properties:
+#       max:
+#         type: integer
+#         default: 5
+#       unit:
+#         type: string
+#         enum: [GB, TB]
+deny_size[msg] {
+    input.properties.size > data.pulumi.config["config.rego:aws.deny_size"].max
+    msg := sprintf("size %v exceeds %v", [input.properties.size, data.pulumi.config["config.rego:aws.deny_size"].max])
+}
+
+warn_tags[msg] {
+    some tag in data.pulumi.config["config.rego:aws.warn_tags"].required
+    not input.properties.tags[tag]
+    msg := sprintf("missing tag %s", [tag])
+}
+`,
+	})
+	a := newTestAnalyzer(t, dir)
+
+	info, err := a.GetAnalyzerInfo()
+	if err != nil {
+		t.Fatalf("getting analyzer info: %v", err)
+	}
+	for _, p := range info.Policies {
+		if p.ConfigSchema == nil {
+			t.Fatalf("expected policy %s to have a config schema", p.Name)
+		}
+	}
+	if max := info.InitialConfig["config.rego:aws.deny_size"].Properties["max"]; max != float64(5) {
+		t.Errorf("expected deny_size to default max to 5, got %v", max)
+	}
+
+	// Defaults apply until configured otherwise.
+	resp, err := a.Analyze(testBucket(map[string]any{"size": 10}))
+	assertMessages(t, messages(t, resp, err), "size 10 exceeds 5")
+
+	err = a.Configure(map[string]plugin.AnalyzerPolicyConfig{
+		"config.rego:aws.deny_size": {Properties: map[string]any{"unit": "GB"}},
+		"config.rego:aws.warn_tags": {Properties: map[string]any{"required": []any{"owner"}}},
+	})
+	if err != nil {
+		t.Fatalf("configuring: %v", err)
+	}
+	resp, err = a.Analyze(testBucket(map[string]any{"size": 10}))
+	assertMessages(t, messages(t, resp, err), "missing tag owner", "size 10 exceeds 5")
+
+	err = a.Configure(map[string]plugin.AnalyzerPolicyConfig{
+		"config.rego:aws.deny_size": {Properties: map[string]any{"max": "big"}},
+	})
+	if err == nil || !strings.Contains(err.Error(), "deny_size") || !strings.Contains(err.Error(), "max:") {
+		t.Fatalf("expected an error naming the rule and field, got %v", err)
+	}
+}
+
+func TestEnforcementLevels(t *testing.T) {
+	dir := writePack(t, map[string]string{
+		"PulumiPolicy.yaml": `runtime: opa
+rules:
+  levels.rego:aws.deny_broken:
+    enforcementLevel: disabled
+  levels.rego:aws.warn_acl:
+    enforcementLevel: remediate
+`,
+		"levels.rego": `package aws
+
+# Produces an invalid violation, so evaluating it at all is an error.
+deny_broken[violation] {
+    violation := 42
+}
+
+warn_acl[msg] {
+    input.properties.acl == "public-read"
+    msg := "public ACL"
+}
+
+remediate_acl = object.union(input.properties, {"acl": "private"}) {
+    input.properties.acl == "public-read"
+}
+`,
+	})
+	a := newTestAnalyzer(t, dir)
+	bucket := testBucket(map[string]any{"acl": "public-read"})
+
+	info, err := a.GetAnalyzerInfo()
+	if err != nil {
+		t.Fatalf("getting analyzer info: %v", err)
+	}
+	levels := make(map[string]apitype.EnforcementLevel)
+	for _, p := range info.Policies {
+		levels[p.Name] = p.EnforcementLevel
+	}
+	if levels["levels.rego:aws.deny_broken"] != apitype.Disabled || levels["levels.rego:aws.warn_acl"] != apitype.Remediate {
+		t.Fatalf("expected levels from the manifest, got %v", levels)
+	}
+
+	// Remediate-level rules that only report violations report them as mandatory.
+	resp, err := a.Analyze(bucket)
+	assertMessages(t, messages(t, resp, err), "public ACL")
+	if level := resp.Diagnostics[0].EnforcementLevel; level != apitype.Mandatory {
+		t.Errorf("expected a mandatory violation, got %s", level)
+	}
+	remediated, err := a.Remediate(bucket)
+	if err != nil || len(remediated.Remediations) != 1 {
+		t.Fatalf("expected one remediation, got %v (%v)", remediated.Remediations, err)
+	}
+
+	// Remediation rules below the remediate level report what they would do instead.
+	err = a.Configure(map[string]plugin.AnalyzerPolicyConfig{
+		"levels.rego:aws.warn_acl":      {EnforcementLevel: apitype.Disabled},
+		"levels.rego:aws.remediate_acl": {EnforcementLevel: apitype.Advisory},
+	})
+	if err != nil {
+		t.Fatalf("configuring: %v", err)
+	}
+	resp, err = a.Analyze(bucket)
+	assertMessages(t, messages(t, resp, err), "levels.rego:aws.remediate_acl would remediate this resource")
+	if level := resp.Diagnostics[0].EnforcementLevel; level != apitype.Advisory {
+		t.Errorf("expected an advisory violation, got %s", level)
+	}
+	remediated, err = a.Remediate(bucket)
+	if err != nil || len(remediated.Remediations) != 0 {
+		t.Fatalf("expected no remediations, got %v (%v)", remediated.Remediations, err)
+	}
+}
+
+func TestManifestMetadata(t *testing.T) {
+	dir := writePack(t, map[string]string{
+		"PulumiPolicy.yaml": `name: aws-security
+displayName: AWS Security
+version: 1.2.3
+description: Keeps AWS resources secure.
+runtime:
+  name: opa
+requiredPluginVersion: ">=0.0.1"
+rules:
+  s3.rego:aws.deny_acl:
+    displayName: No public ACLs
+    description: Buckets must not be publicly readable.
+    message: Use a private ACL instead.
+`,
+		"s3.rego": `package aws
+
+deny_acl[msg] {
+    input.properties.acl == "public-read"
+    msg := "public ACL"
+}
+`,
+	})
+	a := newTestAnalyzer(t, dir)
+
+	info, err := a.GetAnalyzerInfo()
+	if err != nil {
+		t.Fatalf("getting analyzer info: %v", err)
+	}
+	if info.Name != "aws-security" || info.DisplayName != "AWS Security" || info.Version != "1.2.3" ||
+		info.Description != "Keeps AWS resources secure." {
+		t.Errorf("expected pack metadata from the manifest, got %+v", info)
+	}
+	p := info.Policies[0]
+	if p.DisplayName != "No public ACLs" || p.Description != "Buckets must not be publicly readable." ||
+		p.Message != "Use a private ACL instead." {
+		t.Errorf("expected rule metadata from the manifest, got %+v", p)
+	}
+
+	resp, err := a.Analyze(testBucket(map[string]any{"acl": "public-read"}))
+	assertMessages(t, messages(t, resp, err), "public ACL")
+	if d := resp.Diagnostics[0]; d.PolicyPackName != "aws-security" || d.PolicyPackVersion != "1.2.3" {
+		t.Errorf("expected diagnostics from aws-security@1.2.3, got %s@%s", d.PolicyPackName, d.PolicyPackVersion)
+	}
+}
+
+func TestLoadManifestErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		manifest string
+		want     string
+	}{
+		{"unknown key", "runtime: opa\ndescripton: typo\n", `PulumiPolicy.yaml:2: unknown setting "descripton"`},
+		{"unknown rule key", "runtime: opa\nrules:\n  deny:\n    unknown: skip\n", "PulumiPolicy.yaml:4:"},
+		{"malformed", "runtime: opa\nrules: [\n", "line 2"},
+		{"bad name", "runtime: opa\nname: has spaces\n", "PulumiPolicy.yaml:2:"},
+		{"bad version", "version: latest\n", "PulumiPolicy.yaml:1:"},
+		{"bad level", "rules:\n  deny:\n    enforcementLevel: strict\n", "PulumiPolicy.yaml:3:"},
+		{"unknown rule", "rules:\n  s3.rego:aws.deny:\n    unknowns: skip\n  deny_nothing: {}\n", "PulumiPolicy.yaml:4:"},
+		{"newer plugin", "requiredPluginVersion: '>=99.0.0'\n", "requires analyzer version >=99.0.0"},
+		{"bad timeout", "timeouts:\n  rule: soon\n", "PulumiPolicy.yaml:2:"},
+		{"bad rule timeout", "rules:\n  deny:\n    timeout: -1s\n", "PulumiPolicy.yaml:3:"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writePack(t, map[string]string{
+				"PulumiPolicy.yaml": tt.manifest,
+				"s3.rego":           "package aws\n\ndeny[msg] {\n    msg := \"x\"\n}\n",
+			})
+			_, _, err := loadPolicyPack(dir)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("expected an error mentioning %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestAnnotations(t *testing.T) {
+	dir := writePack(t, map[string]string{
+		"PulumiPolicy.yaml": `runtime: opa
+rules:
+  s3.rego:aws.deny_acl:
+    message: From the manifest.
+`,
+		"s3.rego": `package aws
+
+# METADATA
+# title: No public ACLs
+# description: Buckets must not be publicly readable.
+# custom:
+#   message: Use a private ACL instead.
+#   severity: high
+deny_acl[msg] {
+    input.properties.acl == "public-read"
+    msg := "public ACL"
+}
+
+# METADATA
+# title: Versioning
+# description: Buckets should be versioned.
+# custom:
+#   enforcement: advisory
+#   severity: low
+unversioned_bucket {
+    not input.properties.versioning.enabled
+}
+
+# METADATA
+# description: Buckets should log access.
+# entrypoint: true
+unlogged_bucket {
+    not input.properties.logging
+}
+
+# METADATA
+# title: Sensitive fields
+# description: Annotations that only document a rule don't make it a policy.
+sensitive_fields := {"password", "token"}
+
+# Not a policy, since it is neither annotated nor named like one.
+helper {
+    true
+}
+`,
+	})
+	a := newTestAnalyzer(t, dir)
+
+	info, err := a.GetAnalyzerInfo()
+	if err != nil {
+		t.Fatalf("getting analyzer info: %v", err)
+	}
+	policies := make(map[string]plugin.AnalyzerPolicyInfo)
+	for _, p := range info.Policies {
+		policies[p.Name] = p
+	}
+	if len(policies) != 3 {
+		t.Fatalf("expected deny_acl, unversioned_bucket and unlogged_bucket, got %v", policies)
+	}
+	acl := policies["s3.rego:aws.deny_acl"]
+	if acl.DisplayName != "No public ACLs" || acl.Description != "Buckets must not be publicly readable." ||
+		acl.Message != "From the manifest." || acl.Severity != apitype.PolicySeverityHigh ||
+		acl.EnforcementLevel != apitype.Mandatory {
+		t.Errorf("unexpected metadata for deny_acl: %+v", acl)
+	}
+	versioning := policies["s3.rego:aws.unversioned_bucket"]
+	if versioning.EnforcementLevel != apitype.Advisory || versioning.Severity != apitype.PolicySeverityLow {
+		t.Errorf("unexpected metadata for unversioned_bucket: %+v", versioning)
+	}
+
+	resp, err := a.Analyze(testBucket(map[string]any{"acl": "public-read"}))
+	assertMessages(t, messages(t, resp, err), "Buckets should be versioned.", "Buckets should log access.",
+		"public ACL")
+}
+
+func TestAnnotationsRejectInvalidValues(t *testing.T) {
+	dir := writePack(t, map[string]string{
+		"s3.rego": `package aws
+
+# METADATA
+# custom:
+#   severity: dire
+deny[msg] {
+    msg := "x"
+}
+`,
+	})
+	if _, _, err := loadPolicyPack(dir); err == nil || !strings.Contains(err.Error(), "dire") {
+		t.Fatalf("expected an error for an unknown severity, got %v", err)
+	}
+}
+
+func TestPackages(t *testing.T) {
+	dir := writePack(t, map[string]string{
+		"PulumiPolicy.yaml": `runtime: opa
+root: aws
+rules:
+  aws/iam.rego:aws.iam.deny:
+    enforcementLevel: advisory
+`,
+		"lib/aws.rego": `package lib.aws
+
+is_public(acl) {
+    acl == "public-read"
+}
+
+# Named like a policy, but outside of the pack's root.
+deny[msg] {
+    msg := "not a policy"
+}
+`,
+		"aws/s3.rego": `package aws.s3
+
+import data.lib.aws
+
+deny[msg] {
+    aws.is_public(input.properties.acl)
+    msg := "public bucket"
+}
+`,
+		"aws/iam.rego": `package aws.iam
+
+deny[msg] {
+    input.properties.acl == "public-read"
+    msg := "public access"
+}
+`,
+	})
+	a := newTestAnalyzer(t, dir)
+
+	info, err := a.GetAnalyzerInfo()
+	if err != nil {
+		t.Fatalf("getting analyzer info: %v", err)
+	}
+	if info.Name != "aws" {
+		t.Errorf("expected the pack to be named after its root, got %s", info.Name)
+	}
+	levels := make(map[string]apitype.EnforcementLevel)
+	for _, p := range info.Policies {
+		levels[p.Name] = p.EnforcementLevel
+	}
+	if len(levels) != 2 || levels["aws/s3.rego:aws.s3.deny"] != apitype.Mandatory || levels["aws/iam.rego:aws.iam.deny"] != apitype.Advisory {
+		t.Errorf("expected aws/s3.rego:aws.s3.deny and aws/iam.rego:aws.iam.deny policies, got %v", levels)
+	}
+
+	resp, err := a.Analyze(testBucket(map[string]any{"acl": "public-read"}))
+	assertMessages(t, messages(t, resp, err), "public access", "public bucket")
+
+	// Without a root, policies in unrelated packages leave the pack without a name.
+	dir = writePack(t, map[string]string{
+		"aws.rego": "package aws\n\ndeny[msg] {\n    msg := \"x\"\n}\n",
+		"gcp.rego": "package gcp\n\ndeny[msg] {\n    msg := \"y\"\n}\n",
+	})
+	if _, _, err := loadPolicyPack(dir); err == nil || !strings.Contains(err.Error(), "name the pack") {
+		t.Fatalf("expected an error asking for a pack name, got %v", err)
+	}
+
+	// Policies are named after their package even when there is only one, so that adding another package doesn't
+	// rename them, unless the manifest asks for plain names.
+	files := map[string]string{"s3.rego": "package aws\n\ndeny[msg] {\n    msg := \"x\"\n}\n"}
+	pack, _, err := loadPolicyPack(writePack(t, files))
+	if err != nil || pack.Policies[0].Name != "s3.rego:aws.deny" {
+		t.Fatalf("expected a policy named s3.rego:aws.deny, got %v (%v)", pack, err)
+	}
+	files["PulumiPolicy.yaml"] = "plainNames: true\n"
+	pack, _, err = loadPolicyPack(writePack(t, files))
+	if err != nil || pack.Policies[0].Name != "deny" {
+		t.Fatalf("expected a policy named deny, got %v (%v)", pack, err)
+	}
+	files["iam.rego"] = "package aws.iam\n\ndeny[msg] {\n    msg := \"y\"\n}\n"
+	if _, _, err := loadPolicyPack(writePack(t, files)); err == nil || !strings.Contains(err.Error(), "plainNames") {
+		t.Fatalf("expected an error for policies with the same plain name, got %v", err)
+	}
+}
+
+func TestPackVersion(t *testing.T) {
+	files := map[string]string{
+		"s3.rego": "package aws\n\ndeny[msg] {\n    input.properties.acl == \"public-read\"\n    msg := \"x\"\n}\n",
+	}
+	info := func() plugin.AnalyzerInfo {
+		info, err := newTestAnalyzer(t, writePack(t, files)).GetAnalyzerInfo()
+		if err != nil {
+			t.Fatalf("getting analyzer info: %v", err)
+		}
+		return info
+	}
+
+	// Without a version in the manifest, the pack is versioned by its content.
+	first := info()
+	if !strings.HasPrefix(first.Version, "0.0.0+sha256.") || first.Version == VersionString {
+		t.Errorf("expected a content version, got %s", first.Version)
+	}
+	if len(first.Tags) != 1 || !strings.HasPrefix(first.Tags[0], "sha256:") ||
+		!strings.HasPrefix(first.Tags[0][len("sha256:"):], first.Version[len("0.0.0+sha256."):]) {
+		t.Errorf("expected the content hash in the pack's tags, got %v", first.Tags)
+	}
+	if again := info(); again.Version != first.Version || again.Tags[0] != first.Tags[0] {
+		t.Errorf("expected the same content to have the same version, got %s and %s", first.Version, again.Version)
+	}
+
+	files["s3.rego"] = strings.Replace(files["s3.rego"], "public-read", "public-read-write", 1)
+	if changed := info(); changed.Version == first.Version || changed.Tags[0] == first.Tags[0] {
+		t.Errorf("expected a change to the rules to change the version, got %s", changed.Version)
+	}
+
+	files["PulumiPolicy.yaml"] = "version: 2.0.0\n"
+	if versioned := info(); versioned.Version != "2.0.0" {
+		t.Errorf("expected the manifest's version, got %s", versioned.Version)
+	}
+}
+
+func TestStructuredViolations(t *testing.T) {
+	dir := writePack(t, map[string]string{
+		"s3.rego": `package aws
+
+# METADATA
+# custom:
+#   severity: low
+deny[violation] {
+    input.properties.acl == "public-read"
+    violation := {
+        "msg": "public bucket",
+        "severity": "critical",
+        "details": {"acl": input.properties.acl},
+        "remediation": "Use a private ACL.",
+        "docs_url": "https://example.com/acl",
+        "tags": ["s3", "public-access"],
+    }
+}
+
+deny[msg] {
+    input.properties.acl == "public-read"
+    msg := "still public"
+}
+`,
+	})
+	a := newTestAnalyzer(t, dir)
+
+	resp, err := a.Analyze(testBucket(map[string]any{"acl": "public-read"}))
+	assertMessages(t, messages(t, resp, err), "public bucket", "still public")
+	for _, d := range resp.Diagnostics {
+		switch d.Message {
+		case "public bucket":
+			want := "{\"acl\":\"public-read\"}\nRemediation: Use a private ACL.\nDocs: https://example.com/acl\n" +
+				"Tags: s3, public-access"
+			if d.Description != want || d.Severity != apitype.PolicySeverityCritical {
+				t.Errorf("unexpected diagnostic for a structured violation: %+v", d)
+			}
+		default:
+			if d.Description != "" || d.Severity != apitype.PolicySeverityLow {
+				t.Errorf("expected a plain violation to have the rule's severity, got %+v", d)
+			}
+		}
+	}
+
+	dir = writePack(t, map[string]string{
+		"s3.rego": "package aws\n\ndeny[v] {\n    v := {\"msg\": \"x\", \"tags\": \"s3\"}\n}\n",
+	})
+	_, err = newTestAnalyzer(t, dir).Analyze(testBucket(nil))
+	if err == nil || !strings.Contains(err.Error(), "tags") {
+		t.Fatalf("expected an error for malformed tags, got %v", err)
+	}
+}
+
+func TestCompliance(t *testing.T) {
+	dir := writePack(t, map[string]string{
+		"PulumiPolicy.yaml": `rules:
+  s3.rego:aws.warn_versioning:
+    compliance:
+      soc2: [CC7.1]
+`,
+		"s3.rego": `package aws
+
+# METADATA
+# custom:
+#   compliance:
+#     cis-aws: ["2.1.1", "2.1.2"]
+#     soc2: [CC6.1]
+deny_acl[msg] {
+    input.properties.acl == "public-read"
+    msg := "public ACL"
+}
+
+# METADATA
+# custom:
+#   compliance:
+#     pci-dss: ["1.3.1"]
+warn_versioning[msg] {
+    not input.properties.versioning
+    msg := "unversioned"
+}
+`,
+	})
+	a := newTestAnalyzer(t, dir)
+
+	info, err := a.GetAnalyzerInfo()
+	if err != nil {
+		t.Fatalf("getting analyzer info: %v", err)
+	}
+	for _, p := range info.Policies {
+		switch p.Name {
+		case "s3.rego:aws.deny_acl":
+			if strings.Join(p.Tags, " ") != "cis-aws:2.1.1 cis-aws:2.1.2 soc2:CC6.1" || p.Framework == nil ||
+				p.Framework.Name != "cis-aws" || p.Framework.Reference != "2.1.1, 2.1.2" {
+				t.Errorf("unexpected controls for deny_acl: %v, %+v", p.Tags, p.Framework)
+			}
+		case "s3.rego:aws.warn_versioning":
+			if strings.Join(p.Tags, " ") != "soc2:CC7.1" {
+				t.Errorf("expected the manifest's controls for warn_versioning, got %v", p.Tags)
+			}
+		}
+	}
+	if got := strings.Join(info.Tags[1:], " "); got != "cis-aws:2.1.1 cis-aws:2.1.2 soc2:CC6.1 soc2:CC7.1" {
+		t.Errorf("expected the pack to be tagged with the controls it covers, got %s", got)
+	}
+
+	resp, err := a.Analyze(testBucket(map[string]any{"acl": "public-read", "versioning": true}))
+	assertMessages(t, messages(t, resp, err), "public ACL")
+	if d := resp.Diagnostics[0].Description; d != "Compliance: cis-aws:2.1.1, cis-aws:2.1.2, soc2:CC6.1" {
+		t.Errorf("expected the diagnostic to name the controls its rule covers, got %q", d)
+	}
+
+	pack, _, err := loadPolicyPack(dir)
+	if err != nil {
+		t.Fatalf("loading policy pack: %v", err)
+	}
+	var out strings.Builder
+	if err := printCoverage(&out, pack); err != nil {
+		t.Fatalf("printing coverage: %v", err)
+	}
+	if !strings.Contains(out.String(), "cis-aws    2.1.1    s3.rego:aws.deny_acl\n") ||
+		!strings.Contains(out.String(), "soc2       CC7.1    s3.rego:aws.warn_versioning\n") {
+		t.Errorf("unexpected coverage:\n%s", out.String())
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	dir := writePack(t, map[string]string{
+		"PulumiPolicy.yaml": `discovery:
+  warn: (warn|advise)(_[a-z0-9]+)*
+entrypoints:
+  - query: data.aws.denyPublic
+  - query: data.aws.checks.encrypted
+    enforcementLevel: advisory
+`,
+		"s3.rego": `package aws
+
+import data.aws.checks
+
+deny_s3v2[msg] {
+    input.properties.acl == "public-read"
+    msg := "deny_s3v2"
+}
+
+denyPublic[msg] {
+    input.properties.acl == "public-read"
+    msg := "denyPublic"
+}
+
+advise_logging[msg] {
+    not input.properties.logging
+    msg := "advise_logging"
+}
+
+denyTypo[msg] {
+    msg := "never evaluated"
+}
+`,
+		"checks.rego": `package aws.checks
+
+encrypted[msg] {
+    not input.properties.encrypted
+    msg := "encrypted"
+}
+`,
+	})
+	pack, _, err := loadPolicyPack(dir)
+	if err != nil {
+		t.Fatalf("loading policy pack: %v", err)
+	}
+	if len(pack.warnings) != 1 || !strings.Contains(pack.warnings[0], "denyTypo") {
+		t.Errorf("expected a warning about denyTypo, got %q", pack.warnings)
+	}
+	levels := make(map[string]enforcementLevel)
+	for _, p := range pack.Policies {
+		levels[p.Name] = p.Level
+	}
+	if len(levels) != 4 || levels["aws.denyPublic"] != mandatoryRule || levels["aws.checks.encrypted"] != advisoryRule ||
+		levels["aws.advise_logging"] != advisoryRule {
+		t.Errorf("unexpected policies %v", levels)
+	}
+
+	a := newTestAnalyzer(t, dir)
+	resp, err := a.Analyze(testBucket(map[string]any{"acl": "public-read"}))
+	assertMessages(t, messages(t, resp, err), "deny_s3v2", "denyPublic", "advise_logging", "encrypted")
+
+	for _, manifest := range []string{
+		"entrypoints:\n  - query: data.aws.missing\n",
+		"entrypoints:\n  - query: input.x\n",
+		"discovery:\n  deny: (\n",
+	} {
+		dir := writePack(t, map[string]string{"PulumiPolicy.yaml": manifest, "s3.rego": "package aws\n"})
+		if _, _, err := loadPolicyPack(dir); err == nil || !strings.Contains(err.Error(), "PulumiPolicy.yaml:") {
+			t.Errorf("expected an error for %q, got %v", manifest, err)
+		}
+	}
+}
+
+func TestRulesSplitBetweenFiles(t *testing.T) {
+	dir := writePack(t, map[string]string{
+		"PulumiPolicy.yaml": `rules:
+  iam_security.rego:aws.deny:
+    enforcementLevel: advisory
+`,
+		"s3_security.rego": `package aws
+
+# METADATA
+# title: S3 security
+deny[msg] {
+    input.properties.acl == "public-read"
+    msg := "public bucket"
+}
+
+# METADATA
+# scope: document
+# description: Only describes the rule in this file.
+# custom:
+#   enforcement: advisory
+#   severity: low
+
+deny[msg] {
+    not input.properties.versioning
+    msg := "unversioned bucket"
+}
+
+warn[msg] {
+    msg := "only in s3_security"
+}
+`,
+		"iam_security.rego": `package aws
+
+deny[msg] {
+    input.properties.acl == "public-read"
+    msg := "public access"
+}
+
+# Rules that use the whole document see every file's violations.
+too_many {
+    count(deny) > 2
+}
+`,
+	})
+	a := newTestAnalyzer(t, dir)
+
+	info, err := a.GetAnalyzerInfo()
+	if err != nil {
+		t.Fatalf("getting analyzer info: %v", err)
+	}
+	var names []string
+	for _, p := range info.Policies {
+		names = append(names, p.Name)
+		if p.Name == "s3_security.rego:aws.deny" && (p.DisplayName != "S3 security" ||
+			p.Description != "Only describes the rule in this file." || p.EnforcementLevel != apitype.Advisory) {
+			t.Errorf("expected s3_security.rego:aws.deny to keep its annotations, got %+v", p)
+		}
+		if p.Name == "iam_security.rego:aws.deny" && (p.EnforcementLevel != apitype.Advisory ||
+			p.DisplayName == "S3 security" || p.Description != "" || p.Severity == apitype.PolicySeverityLow) {
+			t.Errorf("expected iam_security.rego:aws.deny to be advisory, without s3_security's annotations, got %+v", p)
+		}
+	}
+	if got := strings.Join(names, " "); got != "iam_security.rego:aws.deny s3_security.rego:aws.deny s3_security.rego:aws.warn" {
+		t.Errorf("expected a policy per file and rule, in order, got %s", got)
+	}
+
+	resp, err := a.Analyze(testBucket(map[string]any{"acl": "public-read"}))
+	assertMessages(t, messages(t, resp, err), "public access", "public bucket", "unversioned bucket",
+		"only in s3_security")
+	for _, d := range resp.Diagnostics {
+		want := "s3_security.rego:aws.deny"
+		switch d.Message {
+		case "public access":
+			want = "iam_security.rego:aws.deny"
+		case "only in s3_security":
+			want = "s3_security.rego:aws.warn"
+		}
+		if d.PolicyName != want {
+			t.Errorf("expected %q to be reported by %s, got %s", d.Message, want, d.PolicyName)
+		}
+	}
+
+	// Adding a file that defines the same rule leaves the names of existing policies, and their settings, alone.
+	files := map[string]string{
+		"PulumiPolicy.yaml":         "rules:\n  policies/s3_security.rego:aws.deny:\n    enforcementLevel: advisory\n",
+		"policies/s3_security.rego": "package aws\n\ndeny[msg] {\n    msg := \"s3\"\n}\n",
+	}
+	for _, want := range []string{
+		"policies/s3_security.rego:aws.deny",
+		"policies/iam_security.rego:aws.deny policies/s3_security.rego:aws.deny",
+	} {
+		pack, _, err := loadPolicyPack(writePack(t, files))
+		if err != nil {
+			t.Fatalf("loading policy pack: %v", err)
+		}
+		names = nil
+		for _, p := range pack.Policies {
+			names = append(names, p.Name)
+		}
+		if got := strings.Join(names, " "); got != want {
+			t.Errorf("expected policies %s, got %s", want, got)
+		}
+		files["policies/iam_security.rego"] = "package aws\n\ndeny[msg] {\n    msg := \"iam\"\n}\n"
+	}
+}
+
+func TestEvalErrorsNameTheirRule(t *testing.T) {
+	dir := writePack(t, map[string]string{
+		"s3.rego": `package aws
+
+deny[msg] {
+    msg := "fine"
+}
+
+# METADATA
+# title: Conflicting
+deny_conflict = x {
+    x := "one"
+}
+
+deny_conflict = x {
+    x := "two"
+}
+`,
+	})
+	_, err := newTestAnalyzer(t, dir).Analyze(testBucket(nil))
+	if err == nil || !strings.Contains(err.Error(), "data.aws.deny_conflict") {
+		t.Fatalf("expected an error naming deny_conflict, got %v", err)
+	}
+}
+
+// slowRules is a module with a rule that takes seconds to evaluate, alongside one that doesn't.
+const slowRules = `package aws
+
+deny[msg] {
+    msg := "fine"
+}
+
+deny_slow[msg] {
+    count([1 | numbers.range(1, 5000)[_]; numbers.range(1, 5000)[_]]) > 0
+    msg := "slow"
+}
+`
+
+func TestTimeouts(t *testing.T) {
+	dir := writePack(t, map[string]string{
+		"PulumiPolicy.yaml": "rules:\n  s3.rego:aws.deny_slow:\n    timeout: 10ms\n",
+		"s3.rego":           slowRules,
+	})
+	resp, err := newTestAnalyzer(t, dir).Analyze(testBucket(nil))
+	assertMessages(t, messages(t, resp, err), "fine", "rule s3.rego:aws.deny_slow timed out after 10ms")
+	for _, d := range resp.Diagnostics {
+		if d.Message != "fine" && (d.PolicyName != "s3.rego:aws.deny_slow" || d.EnforcementLevel != apitype.Mandatory) {
+			t.Errorf("expected a mandatory diagnostic from deny_slow, got %+v", d)
+		}
+	}
+
+	// Rules that haven't finished when the resource's time runs out are reported, rather than failing the run. Each
+	// rule is evaluated in a pass of its own, so that the fast one finishes.
+	dir = writePack(t, map[string]string{
+		"PulumiPolicy.yaml": "parallelism: 2\ntimeouts:\n  resource: 20ms\n",
+		"s3.rego":           slowRules,
+	})
+	resp, err = newTestAnalyzer(t, dir).Analyze(testBucket(nil))
+	assertMessages(t, messages(t, resp, err), "fine",
+		"rule s3.rego:aws.deny_slow did not finish before the time allowed for the resource ran out")
+}
+
+func TestCancel(t *testing.T) {
+	dir := writePack(t, map[string]string{"s3.rego": slowRules})
+	a := newTestAnalyzer(t, dir)
+
+	errs := make(chan error)
+	go func() {
+		_, err := a.Analyze(testBucket(nil))
+		errs <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if err := a.Cancel(context.Background()); err != nil {
+		t.Fatalf("canceling: %v", err)
+	}
+	select {
+	case err := <-errs:
+		if err == nil || !strings.Contains(err.Error(), "canceled") {
+			t.Fatalf("expected the evaluation to be canceled, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("evaluation carried on after being canceled")
+	}
+
+	// Evaluations started after canceling fail straight away.
+	if _, err := a.Analyze(testBucket(nil)); err == nil {
+		t.Fatal("expected analyzing after canceling to fail")
+	}
+}
+
+// benchmarkPack writes a pack with many rules, like those of a real pack, that all read the resource.
+func benchmarkPack(b *testing.B) string {
+	var rules strings.Builder
+	rules.WriteString("package aws\n")
+	for i := 0; i < 25; i++ {
+		fmt.Fprintf(&rules, `
+deny_rule%d[msg] {
+    input.type == "aws:s3/bucket:Bucket"
+    input.properties.tags[_] == "rule%d"
+    msg := sprintf("%%s violates rule %d", [input.name])
+}
+
+warn_rule%d[msg] {
+    count(input.properties.tags) > %d
+    msg := sprintf("%%s has too many tags", [input.name])
+}
+`, i, i, i, i, i+10)
+	}
+	return writePack(b, map[string]string{"s3.rego": rules.String()})
+}
+
+func BenchmarkAnalyze(b *testing.B) {
+	a := newTestAnalyzer(b, benchmarkPack(b))
+	r := testBucket(map[string]any{"acl": "private", "tags": []any{"rule3", "rule7"}})
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := a.Analyze(r); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkAnalyzeParallel analyzes resources from many goroutines at once, as the engine does.
+func BenchmarkAnalyzeParallel(b *testing.B) {
+	a := newTestAnalyzer(b, benchmarkPack(b))
+	r := testBucket(map[string]any{"acl": "private", "tags": []any{"rule3", "rule7"}})
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := a.Analyze(r); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+// BenchmarkAnalyzeUnprepared evaluates the same pack as BenchmarkAnalyze by planning a query for every rule on
+// every resource, for comparison.
+func BenchmarkAnalyzeUnprepared(b *testing.B) {
+	pack, e, err := loadPolicyPack(benchmarkPack(b))
+	if err != nil {
+		b.Fatal(err)
+	}
+	input, _ := newResourceInput(testBucket(map[string]any{"acl": "private", "tags": []any{"rule3", "rule7"}}),
+		pack.Input)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, rule := range pack.Policies {
+			_, err := rego.New(
+				rego.Query(rule.ref()),
+				rego.Compiler(e.c),
+				rego.Store(e.state.Load().store),
+				rego.Input(input),
+				rego.SetRegoVersion(ast.RegoV0),
+			).Eval(context.Background())
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// TestConcurrentAnalyze analyzes resources and stacks from many goroutines at once while the pack is reconfigured,
+// as the engine may. `make test_all`, which CI runs, runs it with -race to check that evaluations share the compiler
+// and prepared queries safely.
+func TestConcurrentAnalyze(t *testing.T) {
+	dir := writePack(t, map[string]string{
+		"PulumiPolicy.yaml": "parallelism: 3\n",
+		"s3.rego": `package aws
+
+deny_acl[msg] {
+    input.properties.acl == "public-read"
+    msg := sprintf("%s is public", [input.name])
+}
+
+deny_size[msg] {
+    input.properties.size > data.pulumi.config["s3.rego:aws.deny_size"].max
+    msg := sprintf("%s is too big", [input.name])
+}
+
+warn_tags[msg] {
+    not input.properties.tags
+    msg := sprintf("%s is untagged", [input.name])
+}
+
+deny_stack_count[msg] {
+    count(input.resources) > 2
+    msg := "too many resources"
+}
+`,
+	})
+	a := newTestAnalyzer(t, dir)
+	config := map[string]plugin.AnalyzerPolicyConfig{
+		"s3.rego:aws.deny_size": {Properties: map[string]any{"max": 10}},
+	}
+	if err := a.Configure(config); err != nil {
+		t.Fatalf("configuring: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 20; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			resp, err := a.Analyze(testBucket(map[string]any{"acl": "public-read", "size": 20}))
+			if err == nil && len(resp.Diagnostics) != 3 {
+				err = fmt.Errorf("expected 3 diagnostics, got %v", resp.Diagnostics)
+			}
+			if err != nil {
+				errs <- err
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			resp, err := a.AnalyzeStack(testStack())
+			if err == nil && len(resp.Diagnostics) != 1 {
+				err = fmt.Errorf("expected 1 diagnostic, got %v", resp.Diagnostics)
+			}
+			if err != nil {
+				errs <- err
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if err := a.Configure(config); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestResultCache(t *testing.T) {
+	files := map[string]string{
+		"PulumiPolicy.yaml": "cache:\n  dir: .cache\n",
+		"s3.rego":           "package aws\n\ndeny[msg] {\n    input.properties.acl == \"public-read\"\n    msg := \"public\"\n}\n",
+	}
+	dir := writePack(t, files)
+	bucket := testBucket(map[string]any{"acl": "public-read"})
+
+	resp, err := newTestAnalyzer(t, dir).Analyze(bucket)
+	assertMessages(t, messages(t, resp, err), "public")
+	entries, _ := filepath.Glob(filepath.Join(dir, ".cache", "aws", "*", "*.json"))
+	if len(entries) != 1 {
+		t.Fatalf("expected an entry in the cache, got %v", entries)
+	}
+
+	// Results for unchanged resources come from the cache rather than being evaluated again.
+	if err := os.WriteFile(entries[0], []byte(`{"s3.rego:aws.deny": {"defined": true, "doc": ["cached"]}}`), 0o600); err != nil {
+		t.Fatalf("writing cache entry: %v", err)
+	}
+	resp, err = newTestAnalyzer(t, dir).Analyze(bucket)
+	assertMessages(t, messages(t, resp, err), "cached")
+
+	// Changing the pack invalidates the cache.
+	files["s3.rego"] = strings.Replace(files["s3.rego"], `"public"`, `"changed"`, 1)
+	if err := os.WriteFile(filepath.Join(dir, "s3.rego"), []byte(files["s3.rego"]), 0o600); err != nil {
+		t.Fatalf("writing s3.rego: %v", err)
+	}
+	resp, err = newTestAnalyzer(t, dir).Analyze(bucket)
+	assertMessages(t, messages(t, resp, err), "changed")
+	if _, err := os.Stat(entries[0]); !os.IsNotExist(err) {
+		t.Errorf("expected the old revision's entries to be removed, got %v", err)
+	}
+
+	// The least recently used entries are removed once the cache is full.
+	c, err := openResultCache(t.TempDir(), &policyPack{Name: "aws", Hash: "abc"}, 100)
+	if err != nil {
+		t.Fatalf("opening cache: %v", err)
+	}
+	doc := map[string]cachedDoc{"deny": {Defined: true, Doc: strings.Repeat("x", 30)}}
+	for _, key := range []string{"first", "second", "third"} {
+		c.put(key, doc)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, has := c.get("first"); has {
+		t.Errorf("expected the first entry to have been evicted")
+	}
+	if _, has := c.get("third"); !has {
+		t.Errorf("expected the third entry to be kept")
+	}
+}
+
+func TestResultCacheLeavesOtherFiles(t *testing.T) {
+	// A cache that holds the pack would have its rules mistaken for the entries of other revisions.
+	dir := writePack(t, map[string]string{
+		"PulumiPolicy.yaml": "cache:\n  dir: .\n",
+		"aws/s3.rego":       "package aws\n\ndeny[msg] {\n    msg := \"public\"\n}\n",
+	})
+	if _, _, err := loadPolicyPack(dir); err == nil || !strings.Contains(err.Error(), "must not contain the pack") {
+		t.Fatalf("expected an error for a cache containing the pack, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "aws", "s3.rego")); err != nil {
+		t.Fatalf("expected the pack's rules to be kept: %v", err)
+	}
+
+	// Only the directories of other revisions are removed when the cache is opened.
+	cacheDir := t.TempDir()
+	stale := filepath.Join(cacheDir, "aws", strings.Repeat("0", 64))
+	notes := filepath.Join(cacheDir, "aws", "notes.md")
+	other := filepath.Join(cacheDir, "aws", "other")
+	for _, d := range []string{stale, other} {
+		if err := os.MkdirAll(d, 0o700); err != nil {
+			t.Fatalf("creating %s: %v", d, err)
+		}
+	}
+	if err := os.WriteFile(notes, []byte("notes"), 0o600); err != nil {
+		t.Fatalf("writing notes: %v", err)
+	}
+	if _, err := openResultCache(cacheDir, &policyPack{Name: "aws", Hash: strings.Repeat("1", 64)}, 0); err != nil {
+		t.Fatalf("opening cache: %v", err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("expected the other revision to be removed, got %v", err)
+	}
+	for _, path := range []string{notes, other} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("expected %s to be kept: %v", path, err)
+		}
+	}
+}
+
+func TestResultCacheSkipsSecrets(t *testing.T) {
+	dir := writePack(t, map[string]string{
+		"PulumiPolicy.yaml": "cache:\n  dir: .cache\n",
+		"s3.rego":           "package aws\n\ndeny[msg] {\n    msg := sprintf(\"pw %s\", [input.properties.password])\n}\n",
+	})
+	bucket := testBucket(nil)
+	bucket.Properties = resource.PropertyMap{
+		"password": resource.MakeSecret(resource.NewStringProperty("hunter2-secret")),
+	}
+
+	resp, err := newTestAnalyzer(t, dir).Analyze(bucket)
+	assertMessages(t, messages(t, resp, err), "pw [secret]")
+
+	// Rules may copy secrets into their documents in plaintext, so resources with secrets are never cached.
+	err = filepath.WalkDir(filepath.Join(dir, ".cache"), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if strings.Contains(string(b), "hunter2-secret") {
+			t.Errorf("expected no secrets in the cache, found one in %s", path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("reading cache: %v", err)
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2025, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/open-policy-agent/opa/v1/ast"
+	"github.com/pkg/errors"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+)
+
+// Keys under an OPA `# METADATA` annotation's `custom` section that describe a rule to Pulumi. Together with the
+// standard `title` and `description` they give a rule its metadata:
+//
+//	# METADATA
+//	# title: No public ACLs
+//	# description: S3 buckets must not be publicly readable.
+//	# custom:
+//	#   message: Use a private ACL and grant access through bucket policies instead.
+//	#   enforcement: mandatory
+//	#   severity: high
+//	deny_public_acl[msg] { ... }
+const (
+	messageAnnotationKey     = "message"
+	enforcementAnnotationKey = "enforcement"
+	severityAnnotationKey    = "severity"
+)
+
+// ruleAnnotations returns the annotations that describe a rule: those scoped to any of its definitions, and to
+// the document they define. Package and subpackage annotations describe many rules, so they are not included.
+func ruleAnnotations(as *ast.AnnotationSet, rules ...*ast.Rule) []*ast.Annotations {
+	if as == nil {
+		return nil
+	}
+
+	var result []*ast.Annotations
+	seen := make(map[*ast.Annotations]bool)
+	for _, rule := range rules {
+		for _, ref := range as.Chain(rule) {
+			a := ref.Annotations
+			if a == nil || seen[a] || (a.Scope != "rule" && a.Scope != "document") {
+				continue
+			}
+			seen[a] = true
+			result = append(result, a)
+		}
+	}
+	return result
+}
+
+// optsIn returns true if a rule's annotations make it a policy: either it is marked as an OPA entrypoint, or it
+// is given a message or enforcement level. Annotations that only document a rule, like a title, leave it a library
+// rule.
+func optsIn(annotations []*ast.Annotations) bool {
+	for _, a := range annotations {
+		if a.Entrypoint {
+			return true
+		}
+		if _, has := a.Custom[messageAnnotationKey]; has {
+			return true
+		}
+		if _, has := a.Custom[enforcementAnnotationKey]; has {
+			return true
+		}
+	}
+	return false
+}
+
+// applyAnnotations fills in a rule's metadata from its annotations. Where several annotations give the same
+// piece of metadata, the first wins.
+func (p *policyRule) applyAnnotations(annotations []*ast.Annotations) error {
+	var title, description, message, enforcement, severity string
+	for _, a := range annotations {
+		if title == "" {
+			title = a.Title
+		}
+		if description == "" {
+			description = a.Description
+		}
+		for key, v := range map[string]*string{
+			messageAnnotationKey:     &message,
+			enforcementAnnotationKey: &enforcement,
+			severityAnnotationKey:    &severity,
+		} {
+			raw, has := a.Custom[key]
+			if !has || *v != "" {
+				continue
+			}
+			s, ok := raw.(string)
+			if !ok {
+				return errors.Errorf("%s: custom.%s must be a string, got %v", a.Location, key, raw)
+			}
+			*v = s
+		}
+	}
+
+	if title != "" {
+		p.DisplayName = title
+	}
+	if description != "" {
+		p.Description = description
+	}
+	if message != "" {
+		p.Message = message
+	}
+	if enforcement != "" {
+		level, err := parseEnforcementLevel(apitype.EnforcementLevel(enforcement))
+		if err != nil {
+			return errors.Wrapf(err, "rule %s", p.Name)
+		}
+		p.Level = level
+	}
+	if severity != "" {
+		s, err := parseSeverity(severity)
+		if err != nil {
+			return errors.Wrapf(err, "rule %s", p.Name)
+		}
+		p.Severity = s
+	}
+	return nil
+}
+
+// parseSeverity validates a policy severity.
+func parseSeverity(severity string) (apitype.PolicySeverity, error) {
+	switch s := apitype.PolicySeverity(severity); s {
+	case apitype.PolicySeverityLow, apitype.PolicySeverityMedium, apitype.PolicySeverityHigh,
+		apitype.PolicySeverityCritical:
+		return s, nil
+	default:
+		return "", errors.Errorf("unknown severity %q, expected one of low, medium, high, critical", severity)
+	}
+}
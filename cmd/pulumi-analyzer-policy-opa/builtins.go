@@ -0,0 +1,148 @@
+// Copyright 2025, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/open-policy-agent/opa/v1/ast"
+	"github.com/open-policy-agent/opa/v1/rego"
+	"github.com/open-policy-agent/opa/v1/types"
+	"github.com/pkg/errors"
+)
+
+// The analyzer offers a handful of Pulumi-specific builtins to rules, all under the `pulumi.` namespace. They are
+// registered globally so that the compiler knows about them when type checking the pack's modules.
+func init() {
+	rego.RegisterBuiltin1(&rego.Function{
+		Name:        "pulumi.is_unknown",
+		Description: "Returns true if the value is not known until the resource is created or updated.",
+		Decl: types.NewFunction(
+			types.Args(types.Named("x", types.A)),
+			types.Named("result", types.B),
+		),
+	}, func(_ rego.BuiltinContext, x *ast.Term) (*ast.Term, error) {
+		return ast.BooleanTerm(isUnknownTerm(x)), nil
+	})
+
+	rego.RegisterBuiltin1(&rego.Function{
+		Name:        "pulumi.has_unknowns",
+		Description: "Returns true if the value, or any value nested inside it, is unknown.",
+		Decl: types.NewFunction(
+			types.Args(types.Named("x", types.A)),
+			types.Named("result", types.B),
+		),
+	}, func(_ rego.BuiltinContext, x *ast.Term) (*ast.Term, error) {
+		found := false
+		ast.WalkTerms(x, func(t *ast.Term) bool {
+			found = found || isUnknownTerm(t)
+			return found
+		})
+		return ast.BooleanTerm(found), nil
+	})
+
+	// Each graph builtin takes the stack input's `graph` and a URN, and returns the set of URNs found by following
+	// the given edges transitively from that URN, not including the URN itself.
+	for name, desc := range map[string]struct {
+		description string
+		edges       []string
+	}{
+		"pulumi.graph.ancestors": {
+			"Returns the URNs of a resource's parent, its parent's parent, and so on.",
+			[]string{"parent"},
+		},
+		"pulumi.graph.descendants": {
+			"Returns the URNs of a resource's children, their children, and so on.",
+			[]string{"children"},
+		},
+		"pulumi.graph.dependencies": {
+			"Returns the URNs of all resources a resource depends on, directly or transitively.",
+			[]string{"dependencies"},
+		},
+		"pulumi.graph.dependents": {
+			"Returns the URNs of all resources that depend on a resource, directly or transitively.",
+			[]string{"dependents"},
+		},
+		"pulumi.graph.reachable": {
+			"Returns the URNs of all resources connected to a resource through parents or dependencies.",
+			[]string{"parent", "children", "dependencies", "dependents"},
+		},
+	} {
+		edges := desc.edges
+		rego.RegisterBuiltin2(&rego.Function{
+			Name:        name,
+			Description: desc.description,
+			Decl: types.NewFunction(
+				types.Args(
+					types.Named("graph", types.NewObject(nil, types.NewDynamicProperty(types.S, types.A))),
+					types.Named("urn", types.S),
+				),
+				types.Named("urns", types.NewSet(types.S)),
+			),
+		}, func(_ rego.BuiltinContext, graph, urn *ast.Term) (*ast.Term, error) {
+			g, ok := graph.Value.(ast.Object)
+			if !ok {
+				return nil, errors.Errorf("graph must be an object, got %v", ast.ValueName(graph.Value))
+			}
+			return ast.NewTerm(walkGraph(g, urn, edges)), nil
+		})
+	}
+}
+
+// walkGraph returns every node reachable from start in a stack input graph by following the given edges, which
+// name fields of each node holding either a single URN or an array of them.
+func walkGraph(graph ast.Object, start *ast.Term, edges []string) ast.Set {
+	result := ast.NewSet()
+	queue := []*ast.Term{start}
+	for len(queue) > 0 {
+		urn := queue[0]
+		queue = queue[1:]
+
+		entry := graph.Get(urn)
+		if entry == nil {
+			continue
+		}
+		node, ok := entry.Value.(ast.Object)
+		if !ok {
+			continue
+		}
+		for _, edge := range edges {
+			field := node.Get(ast.StringTerm(edge))
+			if field == nil {
+				continue
+			}
+
+			var next []*ast.Term
+			switch v := field.Value.(type) {
+			case ast.String:
+				if v != "" {
+					next = append(next, field)
+				}
+			case *ast.Array:
+				v.Foreach(func(t *ast.Term) { next = append(next, t) })
+			}
+			for _, t := range next {
+				if !t.Equal(start) && !result.Contains(t) {
+					result.Add(t)
+					queue = append(queue, t)
+				}
+			}
+		}
+	}
+	return result
+}
+
+func isUnknownTerm(t *ast.Term) bool {
+	s, ok := t.Value.(ast.String)
+	return ok && string(s) == unknownValue
+}
@@ -0,0 +1,216 @@
+// Copyright 2025, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// defaultCacheSizeMB is the size the result cache is kept under, unless the manifest says otherwise.
+const defaultCacheSizeMB = 100
+
+// resultCache keeps the documents that rules evaluated to on disk, so that resources that haven't changed since an
+// earlier run, like a previous `pulumi preview`, need not be evaluated again. Entries are keyed by a hash of the
+// pack's configuration, the kind of rules evaluated, and the input document, and hold the document of each rule
+// evaluated. They are kept in a directory per revision of the pack, named after its content hash, and the
+// directories of other revisions are removed when the cache is opened. The least recently used entries are removed
+// whenever the cache grows beyond its size limit.
+type resultCache struct {
+	dir     string // the directory for this revision of the pack.
+	maxSize int64  // the most bytes of entries to keep.
+
+	mu   sync.Mutex
+	size int64 // the bytes of entries currently kept.
+}
+
+// cachedDoc is a rule's document in a cache entry. Defined is false for rules that were undefined for the input.
+type cachedDoc struct {
+	Defined bool `json:"defined"`
+	Doc     any  `json:"doc,omitempty"`
+}
+
+// revisionRegexp matches the names of the directories that hold the entries of a revision of a pack, which are the
+// revision's content hash.
+var revisionRegexp = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// openResultCache opens the result cache in dir for a pack, removing the entries of other revisions of the pack. Only
+// the directories of other revisions are removed; anything else that happens to be in the cache is left alone.
+func openResultCache(dir string, pack *policyPack, maxSize int64) (*resultCache, error) {
+	packDir := filepath.Join(dir, pack.Name)
+	revisions, err := os.ReadDir(packDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "reading result cache %s", packDir)
+	}
+	for _, revision := range revisions {
+		if revision.IsDir() && revisionRegexp.MatchString(revision.Name()) && revision.Name() != pack.Hash {
+			if err := os.RemoveAll(filepath.Join(packDir, revision.Name())); err != nil {
+				return nil, errors.Wrapf(err, "invalidating result cache %s", packDir)
+			}
+		}
+	}
+
+	c := &resultCache{dir: filepath.Join(packDir, pack.Hash), maxSize: maxSize}
+	if err := os.MkdirAll(c.dir, 0o755); err != nil {
+		return nil, errors.Wrapf(err, "creating result cache %s", c.dir)
+	}
+	entries, err := c.entries()
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		c.size += entry.size
+	}
+	return c, nil
+}
+
+// key returns the key of the entry for evaluating rules of a kind against an input, in a configuration of the pack
+// identified by config. Results from other versions of the analyzer, whose builtins may differ, are never used.
+func (c *resultCache) key(config string, kind policyKind, input any) (string, error) {
+	// Go encodes maps with their keys sorted, so equal inputs always encode the same way.
+	b, err := json.Marshal(input)
+	if err != nil {
+		return "", errors.Wrapf(err, "encoding input")
+	}
+	h := sha256.New()
+	h.Write([]byte(VersionString))
+	h.Write([]byte{0})
+	h.Write([]byte(config))
+	h.Write([]byte{0, byte(kind), 0})
+	h.Write(b)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// get returns the documents in an entry, keyed by rule name, if there is one.
+func (c *resultCache) get(key string) (map[string]cachedDoc, bool) {
+	path := filepath.Join(c.dir, key+".json")
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+
+	// Numbers are kept as they are, just as rules produce them.
+	var docs map[string]cachedDoc
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&docs); err != nil {
+		return nil, false
+	}
+
+	// Mark the entry as recently used.
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
+	return docs, true
+}
+
+// put stores the documents in an entry, and then removes the least recently used entries if the cache has grown
+// too large. Failing to store an entry is not an error, since the results can always be evaluated again.
+func (c *resultCache) put(key string, docs map[string]cachedDoc) {
+	b, err := json.Marshal(docs)
+	if err != nil {
+		return
+	}
+
+	// Write the entry to a temporary file first, so that it is never seen half written.
+	tmp, err := os.CreateTemp(c.dir, key+".*.tmp")
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(b)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	path := filepath.Join(c.dir, key+".json")
+	var replaced int64
+	if info, statErr := os.Stat(path); statErr == nil {
+		replaced = info.Size()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.size += int64(len(b)) - replaced
+	if c.size > c.maxSize {
+		c.evict()
+	}
+}
+
+// cacheEntry is an entry found on disk.
+type cacheEntry struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// entries returns the cache's entries, least recently used first.
+func (c *resultCache) entries() ([]cacheEntry, error) {
+	var entries []cacheEntry
+	err := filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || filepath.Ext(path) != ".json" {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		entries = append(entries, cacheEntry{path: path, size: info.Size(), modTime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading result cache %s", c.dir)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].modTime.Before(entries[j].modTime) })
+	return entries, nil
+}
+
+// evict removes the least recently used entries until the cache is within its size limit. The caller must hold mu.
+func (c *resultCache) evict() {
+	entries, err := c.entries()
+	if err != nil {
+		return
+	}
+	c.size = 0
+	for _, entry := range entries {
+		c.size += entry.size
+	}
+	for _, entry := range entries {
+		if c.size <= c.maxSize {
+			break
+		}
+		if err := os.Remove(entry.path); err == nil {
+			c.size -= entry.size
+		}
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2025, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/open-policy-agent/opa/v1/ast"
+	"github.com/pkg/errors"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource/plugin"
+)
+
+// complianceAnnotationKey is the key under an OPA `# METADATA` annotation's `custom` section that lists the
+// compliance controls a rule covers:
+//
+//	# METADATA
+//	# custom:
+//	#   compliance:
+//	#     cis-aws: ["2.1.1", "2.1.2"]
+//	#     soc2: ["CC6.1"]
+const complianceAnnotationKey = "compliance"
+
+// complianceControls maps compliance frameworks, like cis-aws or soc2, to the IDs of the controls in them that a
+// rule covers.
+type complianceControls map[string][]string
+
+// parseComplianceControls reads the compliance controls given in an annotation.
+func parseComplianceControls(raw any) (complianceControls, error) {
+	frameworks, ok := raw.(map[string]any)
+	if !ok {
+		return nil, errors.Errorf("compliance must map frameworks to lists of control IDs, got %v", raw)
+	}
+	controls := make(complianceControls)
+	for framework, ids := range frameworks {
+		list, ok := ids.([]any)
+		if !ok {
+			return nil, errors.Errorf("compliance framework %s must list control IDs, got %v", framework, ids)
+		}
+		for _, id := range list {
+			s, ok := id.(string)
+			if !ok {
+				return nil, errors.Errorf("compliance framework %s has a control ID that is not a string: %v",
+					framework, id)
+			}
+			controls[framework] = append(controls[framework], s)
+		}
+	}
+	return controls, nil
+}
+
+// tags returns the controls as `framework:control` tags, sorted.
+func (c complianceControls) tags() []string {
+	var tags []string
+	for framework, ids := range c {
+		for _, id := range ids {
+			tags = append(tags, framework+":"+id)
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// framework describes the controls in the form Pulumi knows. Pulumi only has room for a single framework per
+// policy, so this is the first of them by name; the rest are only found in the policy's tags.
+func (c complianceControls) framework() *plugin.AnalyzerPolicyComplianceFramework {
+	if len(c) == 0 {
+		return nil
+	}
+	frameworks := make([]string, 0, len(c))
+	for framework := range c {
+		frameworks = append(frameworks, framework)
+	}
+	sort.Strings(frameworks)
+	return &plugin.AnalyzerPolicyComplianceFramework{
+		Name:      frameworks[0],
+		Reference: strings.Join(c[frameworks[0]], ", "),
+	}
+}
+
+// coverage returns the `framework:control` tags that the pack's rules cover, mapped to the names of the rules that
+// cover them.
+func (p *policyPack) coverage() map[string][]string {
+	coverage := make(map[string][]string)
+	for _, rule := range p.Policies {
+		for _, tag := range rule.Compliance.tags() {
+			coverage[tag] = append(coverage[tag], rule.Name)
+		}
+	}
+	return coverage
+}
+
+// printCoverage writes a table of the compliance controls the pack covers, and the rules that cover them.
+func printCoverage(w io.Writer, pack *policyPack) error {
+	coverage := pack.coverage()
+	tags := make([]string, 0, len(coverage))
+	for tag := range coverage {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "FRAMEWORK\tCONTROL\tRULES")
+	for _, tag := range tags {
+		framework, control, _ := strings.Cut(tag, ":")
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", framework, control, strings.Join(coverage[tag], ", "))
+	}
+	return tw.Flush()
+}
+
+// annotatedComplianceControls returns the compliance controls given in the first of a rule's annotations that
+// gives any.
+func annotatedComplianceControls(annotations []*ast.Annotations) (complianceControls, error) {
+	for _, a := range annotations {
+		if raw, has := a.Custom[complianceAnnotationKey]; has {
+			controls, err := parseComplianceControls(raw)
+			if err != nil {
+				return nil, errors.Wrapf(err, "%s", a.Location)
+			}
+			return controls, nil
+		}
+	}
+	return nil, nil
+}
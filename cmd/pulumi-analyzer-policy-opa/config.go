@@ -0,0 +1,114 @@
+// Copyright 2025, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/open-policy-agent/opa/v1/storage/inmem"
+	"github.com/open-policy-agent/opa/v1/util"
+	"github.com/pkg/errors"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource/plugin"
+)
+
+// configure applies the policy configuration Pulumi gives the pack for a stack, replacing any given before. Each
+// rule's configuration properties are made available to rules as `data.pulumi.config.<rule>`, which is an empty
+// object for rules that have none, and a configured enforcement level overrides the one inferred from the rule's
+// name.
+func (e *evaler) configure(pack *policyPack, config map[string]plugin.AnalyzerPolicyConfig) error {
+	rules := make(map[string]*policyRule)
+	for _, rule := range pack.Policies {
+		rules[rule.Name] = rule
+	}
+
+	levels := make(map[string]enforcementLevel)
+	data := make(map[string]any)
+	for _, rule := range pack.Policies {
+		data[rule.Name] = rule.defaultConfig()
+	}
+	for name, c := range config {
+		rule, has := rules[name]
+		if !has {
+			return errors.Errorf("configuration given for unknown rule %s", name)
+		}
+
+		if c.EnforcementLevel != "" {
+			level, err := parseEnforcementLevel(c.EnforcementLevel)
+			if err != nil {
+				return errors.Wrapf(err, "configuring rule %s", name)
+			}
+			levels[name] = level
+		}
+
+		if c.Properties != nil {
+			// Fill in defaults for any properties that are not given, and make sure the result matches the schema.
+			props := rule.defaultConfig()
+			for k, v := range c.Properties {
+				props[k] = v
+			}
+			var doc any = props
+			if err := util.RoundTrip(&doc); err != nil {
+				return errors.Wrapf(err, "configuring rule %s", name)
+			}
+			if rule.config != nil {
+				if err := rule.config.Validate(doc); err != nil {
+					return errors.Errorf("invalid configuration for rule %s: %s", name, configErrors(err))
+				}
+			}
+			data[name] = doc
+		}
+	}
+
+	b, err := json.Marshal(data)
+	if err != nil {
+		return errors.Wrapf(err, "encoding configuration")
+	}
+	hash := sha256.Sum256(b)
+
+	s := &evalState{
+		hash:   hex.EncodeToString(hash[:]),
+		levels: levels,
+		store: inmem.NewFromObject(map[string]any{
+			"pulumi": map[string]any{
+				"config": data,
+			},
+		}),
+	}
+	if err := e.prepare(context.Background(), pack, s); err != nil {
+		return err
+	}
+	e.state.Store(s)
+	return nil
+}
+
+// level returns the enforcement level a rule is evaluated at: the configured level if there is one, and otherwise
+// the level given in the manifest or inferred from the rule's name.
+func (s *evalState) level(rule *policyRule) enforcementLevel {
+	if level, has := s.levels[rule.Name]; has {
+		return level
+	}
+	return rule.Level
+}
+
+// defaultConfig returns the configuration a rule has when it is not configured: the defaults from its schema.
+func (rule *policyRule) defaultConfig() map[string]any {
+	if rule.ConfigSchema == nil {
+		return map[string]any{}
+	}
+	return rule.ConfigSchema.defaults()
+}
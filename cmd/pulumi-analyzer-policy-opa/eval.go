@@ -16,60 +16,586 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/open-policy-agent/opa/v1/ast"
 	"github.com/open-policy-agent/opa/v1/rego"
+	"github.com/open-policy-agent/opa/v1/storage"
 	"github.com/pkg/errors"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
 )
 
 type evaler struct {
-	c *ast.Compiler
+	c     *ast.Compiler
+	patch rego.PreparedEvalQuery // applies JSON Patches for remediation rules.
+	pool  chan struct{}          // bounds the number of queries evaluated at once, across all evaluations.
+	cache *resultCache           // keeps results from earlier runs, if the pack has a cache.
+
+	// state is the pack's current configuration. Configuring the pack replaces it as a whole, so evaluations that
+	// are under way carry on with the configuration they started with.
+	state atomic.Pointer[evalState]
+}
+
+// evalState is a configuration of the pack, along with the queries planned for it. Queries are planned once, when
+// the pack is configured, rather than every time they are evaluated. An evalState is never changed once made, so
+// any number of evaluations may share it.
+type evalState struct {
+	store    storage.Store                          // the base documents rules see under data, such as their config.
+	hash     string                                 // identifies the configuration, for caching results.
+	levels   map[string]enforcementLevel            // configured enforcement levels, keyed by rule name.
+	queries  map[*policyRule]rego.PreparedEvalQuery // each rule's own query.
+	combined map[policyKind][]*combinedQuery        // the enabled rules of each kind, in parts evaluated in parallel.
+}
+
+// combinedQuery evaluates several rules in one pass. Rule i's document is bound to `r<i>` as an array that is empty
+// if the rule is undefined, and otherwise holds the document alone.
+type combinedQuery struct {
+	query rego.PreparedEvalQuery
+	rules []*policyRule
+}
+
+// newEvaler makes an evaluator for a pack compiled by c, configured with the pack's defaults.
+func newEvaler(c *ast.Compiler, pack *policyPack) (*evaler, error) {
+	parallelism := pack.Parallelism
+	if parallelism <= 0 {
+		parallelism = runtime.GOMAXPROCS(0)
+	}
+	e := &evaler{c: c, pool: make(chan struct{}, parallelism)}
+
+	patch, err := rego.New(
+		rego.Query("result := json.patch(input.doc, input.patch)"),
+		rego.SetRegoVersion(ast.RegoV0),
+	).PrepareForEval(context.Background())
+	if err != nil {
+		return nil, errors.Wrapf(err, "preparing JSON Patch query")
+	}
+	e.patch = patch
+	if pack.Cache.Dir != "" {
+		maxSizeMB := pack.Cache.MaxSizeMB
+		if maxSizeMB <= 0 {
+			maxSizeMB = defaultCacheSizeMB
+		}
+		if e.cache, err = openResultCache(pack.Cache.Dir, pack, int64(maxSizeMB)<<20); err != nil {
+			return nil, err
+		}
+	}
+	if err := e.configure(pack, nil); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// prepare plans the queries for the pack's rules in the given configuration. The enabled rules of each kind are
+// split into as many parts as there are workers to evaluate them, or twice that if only some of them have timeouts.
+func (e *evaler) prepare(ctx context.Context, pack *policyPack, s *evalState) error {
+	s.queries = make(map[*policyRule]rego.PreparedEvalQuery)
+	enabled := make(map[policyKind][]*policyRule)
+	for _, rule := range pack.Policies {
+		q, err := e.prepareQuery(ctx, s, rule.ref())
+		if err != nil {
+			return errors.Wrapf(err, "preparing rule %s", rule.ref())
+		}
+		s.queries[rule] = q
+
+		// Remediation rules see each other's changes, so they are always evaluated one at a time.
+		if rule.Kind != remediationPolicy && s.level(rule) != disabledRule {
+			enabled[rule.Kind] = append(enabled[rule.Kind], rule)
+		}
+	}
+
+	// Rules with timeouts are kept apart from those without, so that each part can be given a time budget.
+	s.combined = make(map[policyKind][]*combinedQuery)
+	for kind, rules := range enabled {
+		var timed, untimed []*policyRule
+		for _, rule := range rules {
+			if rule.Timeout != 0 {
+				timed = append(timed, rule)
+			} else {
+				untimed = append(untimed, rule)
+			}
+		}
+		for _, rules := range [][]*policyRule{untimed, timed} {
+			parts := min(cap(e.pool), len(rules))
+			for i := 0; i < parts; i++ {
+				c := &combinedQuery{rules: rules[i*len(rules)/parts : (i+1)*len(rules)/parts]}
+				var terms []string
+				for j, rule := range c.rules {
+					terms = append(terms, fmt.Sprintf("r%d := [v | v := %s]", j, rule.ref()))
+				}
+				q, err := e.prepareQuery(ctx, s, strings.Join(terms, "; "))
+				if err != nil {
+					return errors.Wrapf(err, "preparing rules")
+				}
+				c.query = q
+				s.combined[kind] = append(s.combined[kind], c)
+			}
+		}
+	}
+	return nil
+}
+
+// prepareQuery plans a query against the pack in the given configuration.
+func (e *evaler) prepareQuery(ctx context.Context, s *evalState, query string) (rego.PreparedEvalQuery, error) {
+	return rego.New(
+		rego.Query(query),
+		rego.Compiler(e.c),
+		rego.Store(s.store),
+		rego.SetRegoVersion(ast.RegoV0),
+	).PrepareForEval(ctx)
 }
 
+// level returns the enforcement level a rule is currently evaluated at.
+func (e *evaler) level(rule *policyRule) enforcementLevel {
+	return e.state.Load().level(rule)
+}
+
+// parallel calls f for each of 0 to n-1, as many at once as the worker pool allows, and returns the first error in
+// that order.
+func (e *evaler) parallel(ctx context.Context, n int, f func(i int) error) error {
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			select {
+			case e.pool <- struct{}{}:
+				defer func() { <-e.pool }()
+				errs[i] = f(i)
+			case <-ctx.Done():
+				errs[i] = ctx.Err()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// evalRules evaluates rules of the given kind against an input document, returning the documents of those that are
+// defined, along with messages for those that ran out of time. Results are taken from the pack's cache where they
+// can be, and stored there otherwise, unless some rule ran out of time. Inputs holding secrets, as seen by the
+// converter that built them, are never cached, since rules may copy the secrets into their documents in plaintext.
+func (e *evaler) evalRules(
+	ctx context.Context,
+	s *evalState,
+	kind policyKind,
+	rules []*policyRule,
+	input any,
+	converter *propertyConverter,
+) (map[*policyRule]any, map[*policyRule]string, error) {
+	if e.cache == nil || converter.hasSecrets() {
+		return e.evalQueries(ctx, s, kind, rules, input)
+	}
+
+	key, err := e.cache.key(s.hash, kind, input)
+	if err != nil {
+		return e.evalQueries(ctx, s, kind, rules, input)
+	}
+	cached, has := e.cache.get(key)
+	if has {
+		docs := make(map[*policyRule]any)
+		for _, rule := range rules {
+			doc, found := cached[rule.Name]
+			if !found {
+				has = false
+				break
+			}
+			if doc.Defined {
+				docs[rule] = doc.Doc
+			}
+		}
+		if has {
+			return docs, nil, nil
+		}
+	}
+
+	docs, timeouts, err := e.evalQueries(ctx, s, kind, rules, input)
+	if err != nil || len(timeouts) > 0 {
+		return docs, timeouts, err
+	}
+	if cached == nil {
+		cached = make(map[string]cachedDoc)
+	}
+	for _, rule := range rules {
+		doc, defined := docs[rule]
+		cached[rule.Name] = cachedDoc{Defined: defined, Doc: doc}
+	}
+	e.cache.put(key, cached)
+	return docs, nil, nil
+}
+
+// evalQueries evaluates rules of the given kind against an input document, returning the documents of those that
+// are defined, along with messages for those that ran out of time. All of the enabled rules of the kind are evaluated
+// in a few combined passes, unless some are to be left out, in which case the rest are evaluated one by one.
+//
+// Each rule is given its own timeout, and a combined pass the sum of its rules' timeouts. A pass that fails is
+// evaluated again one rule at a time, to find out which of its rules failed or ran out of time. If ctx expires, the
+// rules that hadn't finished by then are reported as having run out of time; if it is canceled, evaluation fails.
+func (e *evaler) evalQueries(
+	ctx context.Context,
+	s *evalState,
+	kind policyKind,
+	rules []*policyRule,
+	input any,
+) (map[*policyRule]any, map[*policyRule]string, error) {
+	var mu sync.Mutex
+	docs := make(map[*policyRule]any)
+	timeouts := make(map[*policyRule]string)
+	done := make(map[*policyRule]bool)
+	evalEach := func(rules []*policyRule) error {
+		for _, rule := range rules {
+			ruleCtx, cancel := withTimeout(ctx, rule.Timeout)
+			resultSet, err := s.queries[rule].Eval(ruleCtx, rego.EvalInput(input))
+			cancel()
+			if err != nil {
+				switch {
+				case ctx.Err() != nil:
+					// Whether the resource ran out of time or evaluation was canceled is sorted out below.
+					return nil
+				case ruleCtx.Err() == context.DeadlineExceeded:
+					mu.Lock()
+					timeouts[rule], done[rule] = fmt.Sprintf("rule %s timed out after %v", rule.Name, rule.Timeout), true
+					mu.Unlock()
+					continue
+				default:
+					return errors.Wrapf(err, "evaluating rule %s", rule.ref())
+				}
+			}
+			mu.Lock()
+			if len(resultSet) > 0 && len(resultSet[0].Expressions) > 0 {
+				docs[rule] = resultSet[0].Expressions[0].Value
+			}
+			done[rule] = true
+			mu.Unlock()
+		}
+		return nil
+	}
+
+	parts, combined := s.combined[kind], 0
+	for _, part := range parts {
+		combined += len(part.rules)
+	}
+	var err error
+	if combined != len(rules) {
+		err = e.parallel(ctx, len(rules), func(i int) error {
+			return evalEach(rules[i : i+1])
+		})
+	} else {
+		err = e.parallel(ctx, len(parts), func(i int) error {
+			part := parts[i]
+			partCtx, cancel := withTimeout(ctx, part.timeout())
+			defer cancel()
+			resultSet, err := part.query.Eval(partCtx, rego.EvalInput(input))
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				// Evaluate the rules one at a time to find out which of them failed, or ran out of time.
+				return evalEach(part.rules)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for j, rule := range part.rules {
+				if len(resultSet) > 0 {
+					if values, ok := resultSet[0].Bindings[fmt.Sprintf("r%d", j)].([]any); ok && len(values) > 0 {
+						docs[rule] = values[0]
+					}
+				}
+				done[rule] = true
+			}
+			return nil
+		})
+	}
+
+	switch ctx.Err() {
+	case nil:
+		if err != nil {
+			return nil, nil, err
+		}
+	case context.DeadlineExceeded:
+		for _, rule := range rules {
+			if !done[rule] {
+				timeouts[rule] = fmt.Sprintf("rule %s did not finish before the time allowed for the resource ran out",
+					rule.Name)
+			}
+		}
+	default:
+		return nil, nil, errors.Wrap(ctx.Err(), "evaluation canceled")
+	}
+	return docs, timeouts, nil
+}
+
+// timeout returns the time allowed for a combined query, which is the sum of its rules' timeouts, or zero if its
+// rules may take as long as they like.
+func (q *combinedQuery) timeout() time.Duration {
+	var timeout time.Duration
+	for _, rule := range q.rules {
+		if rule.Timeout == 0 {
+			return 0
+		}
+		timeout += rule.Timeout
+	}
+	return timeout
+}
+
+// withTimeout returns a context that expires after timeout, or only with its parent if timeout is zero.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// evalPolicyPack evaluates the pack's rules of the given kind against an input document, built by converter.
 func (e *evaler) evalPolicyPack(
 	ctx context.Context,
 	pack *policyPack,
+	kind policyKind,
 	input any,
+	converter *propertyConverter,
 ) ([]evalPolicyResult, error) {
 	var results []evalPolicyResult
+	s := e.state.Load()
 
+	// Unknown values are only looked for if some rule cares about them.
+	var unknowns []inputPath
+	var foundUnknowns bool
+
+	var rules []*policyRule
 	for _, rule := range pack.Policies {
-		// Build a rego object that can be evaluated.
-		robj := rego.New(
-			rego.Query(fmt.Sprintf("data.%s.%s", pack.Name, rule.Name)),
-			rego.Compiler(e.c),
-			rego.Input(input),
-			rego.SetRegoVersion(ast.RegoV0),
-		)
-
-		resultSet, err := robj.Eval(ctx)
-		if err != nil {
-			return nil, errors.Wrapf(err, "evaluating rule %s.%s", pack.Name, rule.Name)
-		}
-
-		for _, result := range resultSet {
-			for _, expr := range result.Expressions {
-				if ae, ok := expr.Value.([]any); ok && len(ae) > 0 {
-					for _, v := range ae {
-						results = append(results, evalPolicyResult{
-							pack:  pack.Name,
-							rule:  rule.Name,
-							msg:   v.(string),
-							level: rule.Level,
-						})
-					}
+		if rule.Kind != kind || s.level(rule) == disabledRule {
+			continue
+		}
+
+		// Rules that read unknown values may be skipped, deferred or failed instead of evaluated.
+		if rule.Unknowns != evaluateUnknowns {
+			if !foundUnknowns {
+				unknowns, foundUnknowns = findUnknowns(input), true
+			}
+			if result, has := unknownsResult(pack, rule, s.level(rule), unknowns); has {
+				if result != nil {
+					results = append(results, *result)
+				}
+				continue
+			}
+		}
+		rules = append(rules, rule)
+	}
+
+	docs, timeouts, err := e.evalRules(ctx, s, kind, rules, input, converter)
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range rules {
+		// A rule that ran out of time is reported at its own level, rather than holding up the run.
+		if msg, timedOut := timeouts[rule]; timedOut {
+			results = append(results, evalPolicyResult{
+				msg:        msg,
+				pack:       pack.Name,
+				rule:       rule.Name,
+				level:      s.level(rule),
+				severity:   rule.Severity,
+				compliance: rule.Compliance,
+			})
+			continue
+		}
+
+		doc, has := docs[rule]
+		if !has {
+			continue
+		}
+
+		// Most rules produce a set of violations, but complete rules, like those discovered through their
+		// annotations, may produce a single violation instead.
+		values, ok := doc.([]any)
+		if !ok {
+			values = []any{doc}
+		}
+		for _, v := range values {
+			// A rule that is simply true reports its own message.
+			if b, isBool := v.(bool); isBool {
+				if !b {
+					continue
 				}
+				v = rule.defaultMessage()
 			}
+			violation, err := parseViolation(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "evaluating rule %s", rule.ref())
+			}
+			violation.pack, violation.rule, violation.level = pack.Name, rule.Name, s.level(rule)
+			if violation.severity == "" {
+				violation.severity = rule.Severity
+			}
+			violation.compliance = rule.Compliance
+			results = append(results, violation)
 		}
 	}
 
 	return results, nil
 }
 
+// unknownsResult applies a rule's unknowns policy. If the rule reads any of the given unknown paths it returns
+// true, along with the result to report in place of evaluating the rule, if any.
+func unknownsResult(
+	pack *policyPack,
+	rule *policyRule,
+	level enforcementLevel,
+	unknowns []inputPath,
+) (*evalPolicyResult, bool) {
+	path, has := readsUnknown(rule.reads, unknowns)
+	if !has {
+		return nil, false
+	}
+
+	switch rule.Unknowns {
+	case deferUnknowns:
+		return &evalPolicyResult{
+			pack:     pack.Name,
+			rule:     rule.Name,
+			msg:      fmt.Sprintf("input.%s is not known yet", path),
+			level:    level,
+			deferred: true,
+		}, true
+	case failUnknowns:
+		return &evalPolicyResult{
+			pack:     pack.Name,
+			rule:     rule.Name,
+			msg:      fmt.Sprintf("%s cannot be evaluated because input.%s is not known yet", rule.Name, path),
+			level:    level,
+			severity: rule.Severity,
+		}, true
+	default:
+		return nil, true
+	}
+}
+
+// parseViolation interprets a value produced by a rule. Rules produce either a message, or an object that
+// describes the violation in more detail:
+//
+//	{
+//	    "msg": "...",             // the message, which is required.
+//	    "urn": "...",             // the resource the violation is attributed to.
+//	    "severity": "high",       // overrides the rule's own severity.
+//	    "details": ...,           // more about the violation; anything other than a string is reported as JSON.
+//	    "remediation": "...",     // how to fix the violation.
+//	    "docs_url": "...",        // where to read more.
+//	    "tags": ["...", ...],     // free-form labels.
+//	}
+func parseViolation(v any) (evalPolicyResult, error) {
+	switch v := v.(type) {
+	case string:
+		return evalPolicyResult{msg: v}, nil
+	case map[string]any:
+		var result evalPolicyResult
+		var ok bool
+		if result.msg, ok = v["msg"].(string); !ok {
+			return evalPolicyResult{}, errors.Errorf("violation %v must have a string msg", v)
+		}
+
+		var urn, severity string
+		for key, s := range map[string]*string{
+			"urn":         &urn,
+			"severity":    &severity,
+			"remediation": &result.remediation,
+			"docs_url":    &result.docsURL,
+		} {
+			if raw, has := v[key]; has {
+				if *s, ok = raw.(string); !ok {
+					return evalPolicyResult{}, errors.Errorf("violation %v must have a string %s", v, key)
+				}
+			}
+		}
+		result.urn = resource.URN(urn)
+		if severity != "" {
+			s, err := parseSeverity(severity)
+			if err != nil {
+				return evalPolicyResult{}, errors.Wrapf(err, "violation %v", v)
+			}
+			result.severity = s
+		}
+
+		switch details := v["details"].(type) {
+		case nil:
+		case string:
+			result.details = details
+		default:
+			b, err := json.Marshal(details)
+			if err != nil {
+				return evalPolicyResult{}, errors.Wrapf(err, "violation %v has invalid details", v)
+			}
+			result.details = string(b)
+		}
+
+		if raw, has := v["tags"]; has {
+			tags, ok := raw.([]any)
+			if !ok {
+				return evalPolicyResult{}, errors.Errorf("violation %v must have an array of string tags", v)
+			}
+			for _, tag := range tags {
+				s, ok := tag.(string)
+				if !ok {
+					return evalPolicyResult{}, errors.Errorf("violation %v must have an array of string tags", v)
+				}
+				result.tags = append(result.tags, s)
+			}
+		}
+		return result, nil
+	default:
+		return evalPolicyResult{}, errors.Errorf("violation %v must be a string or an object", v)
+	}
+}
+
 type evalPolicyResult struct {
 	pack  string
 	rule  string
 	msg   string
+	urn   resource.URN // the resource the violation is attributed to, if the rule named one.
 	level enforcementLevel
+	// deferred is true when the rule was not evaluated because it reads unknown values, in which case msg
+	// explains why.
+	deferred bool
+
+	// More about the violation, for rules that describe their violations with objects.
+	severity    apitype.PolicySeverity
+	details     string
+	remediation string
+	docsURL     string
+	tags        []string
+	compliance  complianceControls // the compliance controls the rule covers.
+}
+
+// description describes the violation beyond its message, from the details, remediation, docs and tags that the
+// rule gave for it, and the compliance controls the rule covers.
+func (r *evalPolicyResult) description() string {
+	var lines []string
+	if r.details != "" {
+		lines = append(lines, r.details)
+	}
+	if r.remediation != "" {
+		lines = append(lines, "Remediation: "+r.remediation)
+	}
+	if r.docsURL != "" {
+		lines = append(lines, "Docs: "+r.docsURL)
+	}
+	if len(r.tags) > 0 {
+		lines = append(lines, "Tags: "+strings.Join(r.tags, ", "))
+	}
+	if len(r.compliance) > 0 {
+		lines = append(lines, "Compliance: "+strings.Join(r.compliance.tags(), ", "))
+	}
+	return strings.Join(lines, "\n")
 }
@@ -0,0 +1,396 @@
+// Copyright 2025, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource/plugin"
+)
+
+// inputFormat names the translator that produces the document rules see as `input`.
+type inputFormat string
+
+const (
+	// resourceInput wraps the resource in an envelope that keeps its metadata apart from its properties:
+	//
+	//     {
+	//         "urn":        "urn:pulumi:dev::app::aws:s3/bucket:Bucket::my-bucket",
+	//         "type":       "aws:s3/bucket:Bucket",
+	//         "name":       "my-bucket",
+	//         "properties": { "acl": "private", ... },
+	//         "secrets":    [ "password", ... ],
+	//         "unknowns":   [ "arn", ... ],
+	//         "options":    { "protect": false, ... },
+	//         "provider":   { "urn": "...", "type": "pulumi:providers:aws", ... }
+	//     }
+	//
+	// `secrets` and `unknowns` list the paths of secret and unknown properties; see propertyConverter. See newOptionsInput and
+	// newProviderInput for the shapes of the options and provider.
+	resourceInput inputFormat = "resource"
+	// propertiesInput places the resource's properties at the top level of the document, for compatibility
+	// with packs written against bare property bags. The resource's metadata is mixed in under the reserved
+	// keys `type`, `__name`, `__urn`, `__secrets`, `__unknowns`, `__options` and `__provider`, which take
+	// precedence over properties of the same name.
+	propertiesInput inputFormat = "properties"
+	// kubernetesAdmissionInput presents Kubernetes resources as an AdmissionReview; see translateAdmissionReview.
+	kubernetesAdmissionInput inputFormat = "kubernetes-admission"
+)
+
+// translator rewrites a Pulumi resource into the schema a pack's rules are written against. Translators convert
+// property values with the given converter so that secrets are tracked no matter which schema is in use.
+type translator interface {
+	translate(c *propertyConverter, r plugin.AnalyzerResource) map[string]any
+}
+
+// translatorFunc adapts a plain function to the translator interface.
+type translatorFunc func(c *propertyConverter, r plugin.AnalyzerResource) map[string]any
+
+func (f translatorFunc) translate(c *propertyConverter, r plugin.AnalyzerResource) map[string]any {
+	return f(c, r)
+}
+
+// translators holds the built-in translators, keyed by the name a manifest uses to select them.
+var translators = map[inputFormat]translator{
+	resourceInput:            translatorFunc(translateResource),
+	propertiesInput:          translatorFunc(translateProperties),
+	kubernetesAdmissionInput: translatorFunc(translateAdmissionReview),
+}
+
+func (f inputFormat) isValid() bool {
+	_, has := translators[f]
+	return has
+}
+
+// knownInputFormats returns the names of all built-in translators, sorted for use in error messages.
+func knownInputFormats() []string {
+	var names []string
+	for name := range translators {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// formatFor picks the input format for a resource: a provider package override if one is configured, and the
+// pack-wide format otherwise.
+func (s inputSettings) formatFor(r plugin.AnalyzerResource) inputFormat {
+	if format, has := s.Providers[string(r.Type.Package().Name())]; has {
+		return format
+	}
+	return s.Format
+}
+
+// translatorFor picks the translator for a resource's input format.
+func (s inputSettings) translatorFor(r plugin.AnalyzerResource) translator {
+	return translators[s.formatFor(r)]
+}
+
+// Keys used by the stack input document.
+const (
+	inputResourcesKey = "resources"
+	inputGraphKey     = "graph"
+)
+
+// Keys used by the resource input envelope.
+const (
+	inputURNKey        = "urn"
+	inputTypeKey       = "type"
+	inputNameKey       = "name"
+	inputPropertiesKey = "properties"
+	inputSecretsKey    = "secrets"
+	inputUnknownsKey   = "unknowns"
+	inputOptionsKey    = "options"
+	inputProviderKey   = "provider"
+)
+
+// isResourceInputKey returns true if key is one of the keys of the resource input envelope.
+func isResourceInputKey(key string) bool {
+	switch key {
+	case inputURNKey, inputTypeKey, inputNameKey, inputPropertiesKey, inputSecretsKey, inputUnknownsKey,
+		inputOptionsKey, inputProviderKey:
+		return true
+	}
+	return false
+}
+
+// Reserved keys mixed into the properties input format.
+const (
+	propertiesTypeKey     = "type"
+	propertiesNameKey     = "__name"
+	propertiesURNKey      = "__urn"
+	propertiesSecretsKey  = "__secrets"
+	propertiesUnknownsKey = "__unknowns"
+	propertiesOptionsKey  = "__options"
+	propertiesProviderKey = "__provider"
+)
+
+// propertiesReservedKeys lists the reserved keys of the properties input format.
+var propertiesReservedKeys = []string{
+	propertiesTypeKey, propertiesNameKey, propertiesURNKey, propertiesSecretsKey, propertiesUnknownsKey,
+	propertiesOptionsKey, propertiesProviderKey,
+}
+
+// newResourceInput builds the `input` document for a single resource using the pack's input settings. It also
+// returns the converter used to build it, which can redact the resource's secrets from diagnostics.
+func newResourceInput(r plugin.AnalyzerResource, settings inputSettings) (map[string]any, *propertyConverter) {
+	c := newPropertyConverter()
+	return settings.translatorFor(r).translate(c, r), c
+}
+
+// newStackInput builds the `input` document for stack rules, which holds every resource in the stack, each shaped
+// by the pack's input settings exactly as it would be for resource rules, along with the graph formed by the
+// resources' parents and dependencies:
+//
+//	{
+//	    "resources": [ { "urn": "...", "type": "...", ... }, ... ],
+//	    "graph":     { "<URN>": { "parent": "<URN>", "children": [ ... ], ... }, ... }
+//	}
+//
+// See newGraphInput for the shape of the graph. It also returns the converter used to build the document, which
+// can redact secrets from any of the resources.
+func newStackInput(
+	resources []plugin.AnalyzerStackResource,
+	settings inputSettings,
+) (map[string]any, *propertyConverter) {
+	c := newPropertyConverter()
+	docs := []any{}
+	for _, r := range resources {
+		docs = append(docs, settings.translatorFor(r.AnalyzerResource).translate(c, r.AnalyzerResource))
+	}
+	return map[string]any{
+		inputResourcesKey: docs,
+		inputGraphKey:     newGraphInput(resources),
+	}, c
+}
+
+// newGraphInput presents the parent/child tree and the dependency graph of a stack as an adjacency structure keyed
+// by URN. Every edge is given in both directions so that rules can walk the graph either way:
+//
+//	{
+//	    "<URN>": {
+//	        "parent":               "<URN>",
+//	        "children":             [ "<URN>", ... ],
+//	        "dependencies":         [ "<URN>", ... ],
+//	        "dependents":           [ "<URN>", ... ],
+//	        "propertyDependencies": { "vpcId": [ "<URN>", ... ], ... }
+//	    },
+//	    ...
+//	}
+//
+// `dependencies` includes the dependencies of every property. The pulumi.graph.* builtins answer transitive
+// questions, such as all of a resource's ancestors, from this structure.
+func newGraphInput(resources []plugin.AnalyzerStackResource) map[string]any {
+	type node struct {
+		parent     resource.URN
+		children   map[resource.URN]bool
+		deps       map[resource.URN]bool
+		dependents map[resource.URN]bool
+		propDeps   map[string]any
+	}
+	nodes := make(map[resource.URN]*node)
+	get := func(urn resource.URN) *node {
+		n, has := nodes[urn]
+		if !has {
+			n = &node{
+				children:   make(map[resource.URN]bool),
+				deps:       make(map[resource.URN]bool),
+				dependents: make(map[resource.URN]bool),
+				propDeps:   make(map[string]any),
+			}
+			nodes[urn] = n
+		}
+		return n
+	}
+
+	for _, r := range resources {
+		n := get(r.URN)
+
+		n.parent = r.Parent
+		if n.parent == "" {
+			n.parent = r.Options.Parent
+		}
+		if n.parent != "" {
+			get(n.parent).children[r.URN] = true
+		}
+
+		for _, dep := range r.Dependencies {
+			n.deps[dep] = true
+		}
+		for key, deps := range r.PropertyDependencies {
+			n.propDeps[string(key)] = sortedURNs(deps)
+			for _, dep := range deps {
+				n.deps[dep] = true
+			}
+		}
+		for dep := range n.deps {
+			get(dep).dependents[r.URN] = true
+		}
+	}
+
+	graph := make(map[string]any)
+	for urn, n := range nodes {
+		graph[string(urn)] = map[string]any{
+			"parent":               string(n.parent),
+			"children":             sortedURNSet(n.children),
+			"dependencies":         sortedURNSet(n.deps),
+			"dependents":           sortedURNSet(n.dependents),
+			"propertyDependencies": n.propDeps,
+		}
+	}
+	return graph
+}
+
+func sortedURNs(urns []resource.URN) []any {
+	set := make(map[resource.URN]bool)
+	for _, urn := range urns {
+		set[urn] = true
+	}
+	return sortedURNSet(set)
+}
+
+func sortedURNSet(set map[resource.URN]bool) []any {
+	var urns []string
+	for urn := range set {
+		urns = append(urns, string(urn))
+	}
+	sort.Strings(urns)
+
+	result := []any{}
+	for _, urn := range urns {
+		result = append(result, urn)
+	}
+	return result
+}
+
+// translateResource implements the resourceInput format.
+func translateResource(c *propertyConverter, r plugin.AnalyzerResource) map[string]any {
+	props := c.convertProperties(r.Properties, r.Options.AdditionalSecretOutputs...)
+	doc := map[string]any{
+		inputURNKey:        string(r.URN),
+		inputTypeKey:       string(r.Type),
+		inputNameKey:       r.Name,
+		inputPropertiesKey: props.values,
+		inputSecretsKey:    props.secrets,
+		inputUnknownsKey:   props.unknowns,
+		inputOptionsKey:    newOptionsInput(r.Options),
+	}
+	if r.Provider != nil {
+		doc[inputProviderKey] = newProviderInput(c, r.Provider)
+	}
+	return doc
+}
+
+// translateProperties implements the propertiesInput format.
+func translateProperties(c *propertyConverter, r plugin.AnalyzerResource) map[string]any {
+	props := c.convertProperties(r.Properties, r.Options.AdditionalSecretOutputs...)
+	doc := props.values
+	doc[propertiesTypeKey] = string(r.Type)
+	doc[propertiesNameKey] = r.Name
+	doc[propertiesURNKey] = string(r.URN)
+	doc[propertiesSecretsKey] = props.secrets
+	doc[propertiesUnknownsKey] = props.unknowns
+	doc[propertiesOptionsKey] = newOptionsInput(r.Options)
+	if r.Provider != nil {
+		doc[propertiesProviderKey] = newProviderInput(c, r.Provider)
+	}
+	return doc
+}
+
+// newOptionsInput presents a resource's options to rules. Every option is always present, using its zero value
+// when unset, so that rules can test options without first checking for their existence:
+//
+//	{
+//	    "protect":                 false,
+//	    "ignoreChanges":           [ "tags" ],
+//	    "deleteBeforeReplace":     false,
+//	    "aliases":                 [ "<URN>", ... ],
+//	    "additionalSecretOutputs": [ "password" ],
+//	    "customTimeouts":          { "create": 0, "update": 0, "delete": 0 },
+//	    "parent":                  "<URN>"
+//	}
+//
+// Custom timeouts are expressed in seconds; aliases are normalized to URNs.
+func newOptionsInput(opts plugin.AnalyzerResourceOptions) map[string]any {
+	ignoreChanges := []any{}
+	for _, path := range opts.IgnoreChanges {
+		ignoreChanges = append(ignoreChanges, path)
+	}
+
+	aliases := []any{}
+	for _, urn := range opts.AliasURNs {
+		aliases = append(aliases, string(urn))
+	}
+	for _, alias := range opts.Aliases {
+		aliases = append(aliases, string(alias.GetURN()))
+	}
+
+	secretOutputs := []any{}
+	for _, key := range opts.AdditionalSecretOutputs {
+		secretOutputs = append(secretOutputs, string(key))
+	}
+
+	return map[string]any{
+		"protect":                 opts.Protect,
+		"ignoreChanges":           ignoreChanges,
+		"deleteBeforeReplace":     opts.DeleteBeforeReplace != nil && *opts.DeleteBeforeReplace,
+		"aliases":                 aliases,
+		"additionalSecretOutputs": secretOutputs,
+		"customTimeouts": map[string]any{
+			"create": opts.CustomTimeouts.Create,
+			"update": opts.CustomTimeouts.Update,
+			"delete": opts.CustomTimeouts.Delete,
+		},
+		"parent": string(opts.Parent),
+	}
+}
+
+// newProviderInput presents the provider resource that manages a resource to rules. Translators leave the
+// provider out of the input altogether when there is none, as is the case for component resources and for
+// providers themselves, so that rules can test for it with `not input.provider`:
+//
+//	{
+//	    "urn":        "urn:pulumi:dev::app::pulumi:providers:aws::default_6_0_0",
+//	    "type":       "pulumi:providers:aws",
+//	    "name":       "default_6_0_0",
+//	    "default":    true,
+//	    "properties": { "region": "eu-west-1", ... },
+//	    "secrets":    [ "secretKey", ... ],
+//	    "unknowns":   []
+//	}
+//
+// `default` is true when the engine created the provider implicitly rather than the program declaring it.
+// Providers receive structured configuration, such as assumeRole or defaultTags, as JSON-encoded strings,
+// so rules must use json.unmarshal to inspect them.
+func newProviderInput(c *propertyConverter, p *plugin.AnalyzerProviderResource) map[string]any {
+	props := c.convertProperties(p.Properties)
+	return map[string]any{
+		inputURNKey:        string(p.URN),
+		inputTypeKey:       string(p.Type),
+		inputNameKey:       p.Name,
+		"default":          isDefaultProvider(p.Name),
+		inputPropertiesKey: props.values,
+		inputSecretsKey:    props.secrets,
+		inputUnknownsKey:   props.unknowns,
+	}
+}
+
+// isDefaultProvider reports whether a provider name is one the engine gives to the providers it creates
+// implicitly, i.e. `default` or `default_<version>`.
+func isDefaultProvider(name string) bool {
+	return name == "default" || strings.HasPrefix(name, "default_")
+}
@@ -17,12 +17,26 @@ package main
 import (
 	"os"
 
+	"github.com/pulumi/pulumi/sdk/v3/go/common/diag"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/util/cmdutil"
 )
 
 func main() {
 	args := os.Args[1:]
 
+	// `controls <dir>` lists the compliance controls a pack covers, rather than serving the pack to Pulumi.
+	if len(args) == 2 && args[0] == "controls" {
+		pack, _, err := loadPack(args[1])
+		if err != nil {
+			cmdutil.ExitError(err.Error())
+		}
+		warn(pack)
+		if err := printCoverage(os.Stdout, pack); err != nil {
+			cmdutil.ExitError(err.Error())
+		}
+		return
+	}
+
 	if len(args) < 2 {
 		cmdutil.ExitError("missing required arguments: host and policy pack directory path")
 	}
@@ -31,8 +45,16 @@ func main() {
 	if err != nil {
 		cmdutil.ExitError(err.Error())
 	}
+	warn(pack)
 
 	if err := Serve(pack, e, args); err != nil {
 		cmdutil.ExitError(err.Error())
 	}
 }
+
+// warn reports the problems found while loading a pack that didn't stop it from loading.
+func warn(pack *policyPack) {
+	for _, w := range pack.warnings {
+		cmdutil.Diag().Warningf(diag.Message("", "%s"), w)
+	}
+}
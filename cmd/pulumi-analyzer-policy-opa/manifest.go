@@ -0,0 +1,440 @@
+// Copyright 2025, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/blang/semver"
+	"github.com/open-policy-agent/opa/v1/ast"
+	"github.com/pkg/errors"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+	"gopkg.in/yaml.v3"
+)
+
+// manifestFile is the name of the policy pack manifest that lives at the root of a pack directory.
+const manifestFile = "PulumiPolicy.yaml"
+
+// packNameRegexp matches the names Pulumi accepts for policy packs.
+var packNameRegexp = regexp.MustCompile("^[a-zA-Z0-9-_.]{1,100}$")
+
+// packageRegexp matches the Rego package names that may be given as a pack's root.
+var packageRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*(\.[a-zA-Z_][a-zA-Z0-9_]*)*$`)
+
+// policyManifest holds the contents of a pack's PulumiPolicy.yaml.
+type policyManifest struct {
+	// Name is the pack's name, which defaults to its root package.
+	Name        string `yaml:"name"`
+	DisplayName string `yaml:"displayName"`
+	// Version is the pack's semantic version.
+	Version     string                       `yaml:"version"`
+	Description string                       `yaml:"description"`
+	Runtime     workspace.ProjectRuntimeInfo `yaml:"runtime"`
+	// RequiredPluginVersion is a semantic version range, like ">=0.2.0 <1.0.0", that the analyzer's own
+	// version must satisfy for the pack to load.
+	RequiredPluginVersion string        `yaml:"requiredPluginVersion"`
+	Input                 inputSettings `yaml:"input"`
+	// Parallelism is the most queries evaluated at once, across all of the resources being analyzed. By default,
+	// it is the number of CPUs.
+	Parallelism int `yaml:"parallelism"`
+	// Cache configures the cache of results from earlier runs, which is off unless given a directory.
+	Cache cacheSettings `yaml:"cache"`
+	// Timeouts bounds how long rules may take to evaluate.
+	Timeouts timeoutSettings `yaml:"timeouts"`
+	// Root is the Rego package, like aws, whose rules and those of its subpackages are the pack's policies. Rules in
+	// other packages are only libraries. By default, rules in every package are policies.
+	Root string `yaml:"root"`
+	// PlainNames names policies after their rules alone, like deny, rather than their files and fully qualified
+	// packages, like s3.rego:aws.deny, for packs whose settings and stack configuration use plain names. Rules of the
+	// same name in different files or packages then can't be told apart, and are an error.
+	PlainNames bool `yaml:"plainNames"`
+	// Unknowns is the pack-wide policy for rules that read unknown values; see unknownsPolicy.
+	Unknowns unknownsPolicy `yaml:"unknowns"`
+	// Rules holds per-rule settings, keyed by policy name.
+	Rules map[string]ruleSettings `yaml:"rules"`
+	// Discovery overrides the patterns that rule names are matched against to find policies.
+	Discovery discoverySettings `yaml:"discovery"`
+	// Entrypoints are rules that are policies whatever their names, or packages.
+	Entrypoints []entrypoint `yaml:"entrypoints"`
+
+	// Pulumi's own policy pack settings, which the analyzer accepts but has no use for.
+	Main    string `yaml:"main"`
+	Author  string `yaml:"author"`
+	Website string `yaml:"website"`
+	License string `yaml:"license"`
+
+	path string     // the path the manifest was read from.
+	raw  []byte     // the manifest's contents, if it exists.
+	node *yaml.Node // the parsed document, used to find the lines that settings are on.
+
+	patterns rulePatterns // the patterns rule names are matched against, with Discovery's overrides applied.
+	// defaultInput is true when the manifest doesn't choose an input format, and rules see the resource format.
+	defaultInput bool
+}
+
+// cacheSettings configures the cache of results from earlier runs; see resultCache.
+type cacheSettings struct {
+	// Dir is where the cache is kept. Relative paths are relative to the pack.
+	Dir string `yaml:"dir" json:"dir"`
+	// MaxSizeMB is the most megabytes the cache grows to, which defaults to defaultCacheSizeMB.
+	MaxSizeMB int `yaml:"maxSizeMB" json:"maxSizeMB"`
+}
+
+// timeoutSettings bounds how long rules may take to evaluate, as durations like 5s or 1m. Timeouts that aren't
+// given are unbounded.
+type timeoutSettings struct {
+	// Rule bounds the evaluation of each rule against a resource, or a stack.
+	Rule string `yaml:"rule"`
+	// Resource bounds the evaluation of all of the rules against a resource, or a stack.
+	Resource string `yaml:"resource"`
+
+	rule, resource time.Duration
+}
+
+// discoverySettings overrides the regular expressions that rule names must match in full to be policies of each
+// kind. Patterns that aren't given keep their defaults.
+type discoverySettings struct {
+	Deny      string `yaml:"deny"`
+	Warn      string `yaml:"warn"`
+	DenyStack string `yaml:"denyStack"`
+	WarnStack string `yaml:"warnStack"`
+	Remediate string `yaml:"remediate"`
+}
+
+// entrypoint names a rule to evaluate as a policy.
+type entrypoint struct {
+	// Query refers to the rule, like data.aws.s3.denyPublic.
+	Query string `yaml:"query"`
+	// EnforcementLevel defaults to mandatory, or remediate for remediation rules.
+	EnforcementLevel apitype.EnforcementLevel `yaml:"enforcementLevel"`
+	// Type is one of resource, the default, stack or remediation.
+	Type string `yaml:"type"`
+
+	pkg   string // the package the rule is in.
+	rule  string // the rule's name.
+	level enforcementLevel
+	kind  policyKind
+}
+
+// ruleSettings overrides pack-wide settings for a single rule.
+type ruleSettings struct {
+	DisplayName string `yaml:"displayName"`
+	Description string `yaml:"description"`
+	Message     string `yaml:"message"`
+	// EnforcementLevel overrides the level inferred from the rule's name.
+	EnforcementLevel apitype.EnforcementLevel `yaml:"enforcementLevel"`
+	Unknowns         unknownsPolicy           `yaml:"unknowns"`
+	// Config declares the rule's configuration schema, taking precedence over any in its annotations.
+	Config *configSchema `yaml:"config"`
+	// Compliance lists the compliance controls the rule covers, taking precedence over any in its annotations.
+	Compliance complianceControls `yaml:"compliance"`
+	// Timeout overrides the pack's rule timeout for the rule, like 10s.
+	Timeout string `yaml:"timeout"`
+
+	timeout time.Duration
+}
+
+// inputSettings controls how resources are presented to rules as the `input` document.
+type inputSettings struct {
+	// Format names the translator that shapes the input document; see inputFormat for the choices.
+	Format inputFormat `yaml:"format"`
+	// Providers overrides Format for resources from particular provider packages, keyed by package name
+	// (e.g. kubernetes: kubernetes-admission).
+	Providers map[string]inputFormat `yaml:"providers"`
+}
+
+// loadManifest reads the PulumiPolicy.yaml in dir, if any. A missing manifest is not an error: the
+// resulting manifest simply carries all of the defaults. Unknown settings are errors, so that typos
+// don't silently go unapplied.
+func loadManifest(dir string) (*policyManifest, error) {
+	path := filepath.Join(dir, manifestFile)
+	manifest := &policyManifest{path: path}
+
+	b, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "reading manifest %s", path)
+	}
+	manifest.raw = b
+	if len(bytes.TrimSpace(b)) > 0 {
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		dec.KnownFields(true)
+		if err := dec.Decode(manifest); err != nil {
+			return nil, manifestDecodeError(path, err)
+		}
+		var node yaml.Node
+		if err := yaml.Unmarshal(b, &node); err != nil {
+			return nil, errors.Wrapf(err, "parsing manifest %s", path)
+		}
+		manifest.node = &node
+	}
+
+	if manifest.Name != "" && !packNameRegexp.MatchString(manifest.Name) {
+		return nil, manifest.errorf([]string{"name"},
+			"invalid pack name %q: names may only contain alphanumerics, hyphens, underscores and periods",
+			manifest.Name)
+	}
+	if manifest.Version != "" {
+		if _, err := semver.Parse(manifest.Version); err != nil {
+			return nil, manifest.errorf([]string{"version"}, "invalid version %q: %v", manifest.Version, err)
+		}
+	}
+	if runtime := manifest.Runtime.Name(); runtime != "" && runtime != "opa" {
+		return nil, manifest.errorf([]string{"runtime"}, "unexpected runtime %q, expected opa", runtime)
+	}
+	if manifest.RequiredPluginVersion != "" {
+		required, err := semver.ParseRange(manifest.RequiredPluginVersion)
+		if err != nil {
+			return nil, manifest.errorf([]string{"requiredPluginVersion"}, "invalid version range %q: %v",
+				manifest.RequiredPluginVersion, err)
+		}
+		version, err := semver.Parse(VersionString)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing analyzer version %s", VersionString)
+		}
+		if !required(version) {
+			return nil, manifest.errorf([]string{"requiredPluginVersion"},
+				"the pack requires analyzer version %s, but this is version %s",
+				manifest.RequiredPluginVersion, VersionString)
+		}
+	}
+
+	if manifest.Parallelism < 0 {
+		return nil, manifest.errorf([]string{"parallelism"}, "parallelism must not be negative, got %d",
+			manifest.Parallelism)
+	}
+	if manifest.Cache.Dir != "" {
+		if !filepath.IsAbs(manifest.Cache.Dir) {
+			manifest.Cache.Dir = filepath.Join(dir, manifest.Cache.Dir)
+		}
+		// The cache may be kept within the pack, but not the other way around, since then the pack's own files
+		// would be mistaken for cache entries.
+		if within, err := isWithin(dir, manifest.Cache.Dir); err != nil || within {
+			return nil, manifest.errorf([]string{"cache", "dir"}, "cache directory %s must not contain the pack",
+				manifest.Cache.Dir)
+		}
+	}
+	if manifest.Cache.MaxSizeMB < 0 {
+		return nil, manifest.errorf([]string{"cache", "maxSizeMB"}, "maxSizeMB must not be negative, got %d",
+			manifest.Cache.MaxSizeMB)
+	}
+	if manifest.Root != "" && !packageRegexp.MatchString(manifest.Root) {
+		return nil, manifest.errorf([]string{"root"}, "invalid root package %q", manifest.Root)
+	}
+
+	if manifest.Input.Format == "" {
+		manifest.Input.Format, manifest.defaultInput = resourceInput, true
+	} else if !manifest.Input.Format.isValid() {
+		return nil, manifest.errorf([]string{"input", "format"}, "unknown input format %q, expected one of %s",
+			manifest.Input.Format, strings.Join(knownInputFormats(), ", "))
+	}
+	for pkg, format := range manifest.Input.Providers {
+		if !format.isValid() {
+			return nil, manifest.errorf([]string{"input", "providers", pkg},
+				"unknown input format %q for provider %s, expected one of %s",
+				format, pkg, strings.Join(knownInputFormats(), ", "))
+		}
+	}
+
+	if manifest.Unknowns == "" {
+		manifest.Unknowns = evaluateUnknowns
+	} else if !manifest.Unknowns.isValid() {
+		return nil, manifest.errorf([]string{"unknowns"}, "unknown unknowns policy %q, expected one of %s",
+			manifest.Unknowns, knownUnknownsPolicies)
+	}
+	manifest.patterns = defaultRulePatterns
+	for key, p := range map[string]struct {
+		pattern string
+		re      **regexp.Regexp
+	}{
+		"deny":      {manifest.Discovery.Deny, &manifest.patterns.deny},
+		"warn":      {manifest.Discovery.Warn, &manifest.patterns.warn},
+		"denyStack": {manifest.Discovery.DenyStack, &manifest.patterns.denyStack},
+		"warnStack": {manifest.Discovery.WarnStack, &manifest.patterns.warnStack},
+		"remediate": {manifest.Discovery.Remediate, &manifest.patterns.remediate},
+	} {
+		if p.pattern == "" {
+			continue
+		}
+		re, err := regexp.Compile("^(?:" + p.pattern + ")$")
+		if err != nil {
+			return nil, manifest.errorf([]string{"discovery", key}, "invalid pattern %q: %v", p.pattern, err)
+		}
+		*p.re = re
+	}
+	for i := range manifest.Entrypoints {
+		if err := manifest.Entrypoints[i].parse(); err != nil {
+			return nil, manifest.errorf([]string{"entrypoints"}, "entrypoint %d: %v", i+1, err)
+		}
+	}
+
+	if manifest.Timeouts.rule, err = parseTimeout(manifest.Timeouts.Rule); err != nil {
+		return nil, manifest.errorf([]string{"timeouts", "rule"}, "%v", err)
+	}
+	if manifest.Timeouts.resource, err = parseTimeout(manifest.Timeouts.Resource); err != nil {
+		return nil, manifest.errorf([]string{"timeouts", "resource"}, "%v", err)
+	}
+
+	for name, settings := range manifest.Rules {
+		if settings.timeout, err = parseTimeout(settings.Timeout); err != nil {
+			return nil, manifest.errorf([]string{"rules", name, "timeout"}, "rule %s: %v", name, err)
+		}
+		manifest.Rules[name] = settings
+		if settings.EnforcementLevel != "" {
+			if _, err := parseEnforcementLevel(settings.EnforcementLevel); err != nil {
+				return nil, manifest.errorf([]string{"rules", name, "enforcementLevel"}, "rule %s: %v", name, err)
+			}
+		}
+		if settings.Unknowns != "" && !settings.Unknowns.isValid() {
+			return nil, manifest.errorf([]string{"rules", name, "unknowns"},
+				"unknown unknowns policy %q for rule %s, expected one of %s",
+				settings.Unknowns, name, knownUnknownsPolicies)
+		}
+	}
+
+	return manifest, nil
+}
+
+// yamlErrorRegexp matches the individual errors the YAML decoder reports, like "line 2: field descripton not found
+// in type main.policyManifest".
+var yamlErrorRegexp = regexp.MustCompile(`^line (\d+): (?:field (\S+) not found in type \S+|(.*))$`)
+
+// manifestDecodeError rewrites errors from decoding a manifest to point to the lines at fault in the same way as
+// policyManifest.errorf, and to describe unknown settings without reference to the analyzer's own types.
+func manifestDecodeError(path string, err error) error {
+	var typeErr *yaml.TypeError
+	if !errors.As(err, &typeErr) {
+		return errors.Wrapf(err, "parsing manifest %s", path)
+	}
+
+	var msgs []string
+	for _, e := range typeErr.Errors {
+		m := yamlErrorRegexp.FindStringSubmatch(e)
+		switch {
+		case m == nil:
+			msgs = append(msgs, fmt.Sprintf("%s: %s", path, e))
+		case m[2] != "":
+			msgs = append(msgs, fmt.Sprintf("%s:%s: unknown setting %q", path, m[1], m[2]))
+		default:
+			msgs = append(msgs, fmt.Sprintf("%s:%s: %s", path, m[1], m[3]))
+		}
+	}
+	return errors.New(strings.Join(msgs, "\n"))
+}
+
+// errorf returns an error about the setting at the given path of keys, pointing to the line it is on.
+func (m *policyManifest) errorf(keys []string, format string, args ...any) error {
+	msg := fmt.Sprintf(format, args...)
+	if line := m.line(keys...); line > 0 {
+		return errors.Errorf("%s:%d: %s", m.path, line, msg)
+	}
+	return errors.Errorf("%s: %s", m.path, msg)
+}
+
+// line returns the line of the setting at the given path of keys, or as close to it as the manifest goes. It
+// returns 0 if the manifest has no settings at all.
+func (m *policyManifest) line(keys ...string) int {
+	if m.node == nil || len(m.node.Content) == 0 {
+		return 0
+	}
+
+	node, line := m.node.Content[0], m.node.Content[0].Line
+	for _, key := range keys {
+		if node.Kind != yaml.MappingNode {
+			break
+		}
+		var next *yaml.Node
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == key {
+				next, line = node.Content[i+1], node.Content[i].Line
+				break
+			}
+		}
+		if next == nil {
+			break
+		}
+		node = next
+	}
+	return line
+}
+
+// parse validates the entrypoint and fills in the rule it refers to, and the level and kind of policy it is.
+func (e *entrypoint) parse() error {
+	ref, err := ast.ParseRef(e.Query)
+	if err != nil || len(ref) < 3 || !ref[0].Equal(ast.DefaultRootDocument) {
+		return errors.Errorf("query %q must refer to a rule, like data.aws.deny", e.Query)
+	}
+	var path []string
+	for _, term := range ref[1:] {
+		s, ok := term.Value.(ast.String)
+		if !ok {
+			return errors.Errorf("query %q must refer to a rule, like data.aws.deny", e.Query)
+		}
+		path = append(path, string(s))
+	}
+	e.pkg, e.rule = strings.Join(path[:len(path)-1], "."), path[len(path)-1]
+
+	switch e.Type {
+	case "", "resource":
+		e.level, e.kind = mandatoryRule, resourcePolicy
+	case "stack":
+		e.level, e.kind = mandatoryRule, stackPolicy
+	case "remediation":
+		e.level, e.kind = remediateRule, remediationPolicy
+	default:
+		return errors.Errorf("unknown type %q, expected one of resource, stack, remediation", e.Type)
+	}
+	if e.EnforcementLevel != "" {
+		if e.level, err = parseEnforcementLevel(e.EnforcementLevel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isWithin returns true if path is dir or is inside it.
+func isWithin(path, dir string) (bool, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return false, err
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return false, err
+	}
+	rel, err := filepath.Rel(absDir, absPath)
+	if err != nil {
+		return false, nil
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)), nil
+}
+
+// parseTimeout parses a timeout, which is zero if it isn't given.
+func parseTimeout(timeout string) (time.Duration, error) {
+	if timeout == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(timeout)
+	if err != nil || d <= 0 {
+		return 0, errors.Errorf("invalid timeout %q, expected a positive duration like 5s", timeout)
+	}
+	return d, nil
+}
@@ -15,27 +15,95 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/open-policy-agent/opa/v1/ast"
 	"github.com/pkg/errors"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/santhosh-tekuri/jsonschema/v5"
 )
 
 // Rego modules contain rules, some of which have prefixes. Only those with the appropriate
 // prefix will be considered rules for evaluation -- all others are used as library routines.
+// Rules with a `_stack` suffix on their prefix are evaluated once against the whole stack
+// rather than once per resource, and those with a `remediate` prefix fix resources rather than
+// reporting on them. The manifest may override these patterns.
 var (
-	denyRulePrefix = regexp.MustCompile("^(deny|violation)(_[a-zA-Z]+)*$")
-	warnRulePrefix = regexp.MustCompile("^warn(_[a-zA-Z]+)*$")
+	denyRulePrefix      = regexp.MustCompile("^(deny|violation)(_[a-zA-Z0-9]+)*$")
+	warnRulePrefix      = regexp.MustCompile("^warn(_[a-zA-Z0-9]+)*$")
+	denyStackRulePrefix = regexp.MustCompile("^(deny|violation)_stack(_[a-zA-Z0-9]+)*$")
+	warnStackRulePrefix = regexp.MustCompile("^warn_stack(_[a-zA-Z0-9]+)*$")
+	remediateRulePrefix = regexp.MustCompile("^remediate(_[a-zA-Z0-9]+)*$")
 )
 
-// loadPolicyPack loads the metadata about a pack and its policies from a directory containing OPA *.rego files.
+// policyLikeName matches the names of rules that look like they were meant to be policies. Those that aren't
+// found to be policies are warned about, since they are most likely misnamed.
+var policyLikeName = regexp.MustCompile("(?i)^(deny|violation|warn|remediate)")
+
+// rulePatterns are the patterns that rule names are matched against to find policies.
+type rulePatterns struct {
+	deny, warn, denyStack, warnStack, remediate *regexp.Regexp
+}
+
+// defaultRulePatterns are the patterns used unless the manifest overrides them.
+var defaultRulePatterns = rulePatterns{
+	deny:      denyRulePrefix,
+	warn:      warnRulePrefix,
+	denyStack: denyStackRulePrefix,
+	warnStack: warnStackRulePrefix,
+	remediate: remediateRulePrefix,
+}
+
+// classify returns the level and kind of policy that a rule's name implies, if its name is a policy's at all.
+func (p rulePatterns) classify(ruleName string) (enforcementLevel, policyKind, bool) {
+	switch {
+	case p.denyStack.MatchString(ruleName):
+		return mandatoryRule, stackPolicy, true
+	case p.warnStack.MatchString(ruleName):
+		return advisoryRule, stackPolicy, true
+	case p.deny.MatchString(ruleName):
+		return mandatoryRule, resourcePolicy, true
+	case p.warn.MatchString(ruleName):
+		return advisoryRule, resourcePolicy, true
+	case p.remediate.MatchString(ruleName):
+		return remediateRule, remediationPolicy, true
+	default:
+		return 0, 0, false
+	}
+}
+
+// loadPolicyPack loads the metadata about a pack and its policies from a directory containing OPA *.rego files, along
+// with an evaluator for its rules.
 func loadPolicyPack(dir string) (*policyPack, *evaler, error) {
-	// First open the manifest file to learn more about the pack.
-	// TODO: we need to do this in order to provide metadata about the package itself, like its name,
-	// description, and so on. The idea here is to just put a PulumiPolicy.yaml inside the rules/ directory.
+	pack, compiler, err := loadPack(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Make an evaluator that can actually apply the rules using the pack's compiler.
+	e, err := newEvaler(compiler, pack)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pack, e, nil
+}
+
+// loadPack loads the metadata about a pack and its policies, and compiles its rules, but doesn't prepare to evaluate
+// them, so that the pack's result cache is left alone.
+func loadPack(dir string) (*policyPack, *ast.Compiler, error) {
+	// First open the manifest file to learn more about the pack, like its name, description, and so on.
+	manifest, err := loadManifest(dir)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	// Next gather up all the OPA rego files to run and prepare to compile them.
 	modules := make(map[string]string)
@@ -67,29 +135,45 @@ func loadPolicyPack(dir string) (*policyPack, *evaler, error) {
 	}
 
 	// Compile all of the policy files so we can error out early if there are problems.
-	compiler, err := ast.CompileModulesWithOpt(modules, ast.CompileOpts{
-		ParserOptions: ast.ParserOptions{
-			RegoVersion: ast.RegoV0,
-		},
-	})
+	parsed := make(map[string]*ast.Module)
+	for name, module := range modules {
+		if parsed[name], err = ast.ParseModuleWithOpts(name, module, ast.ParserOptions{
+			RegoVersion:       ast.RegoV0,
+			ProcessAnnotation: true,
+		}); err != nil {
+			return nil, nil, errors.Wrapf(err, "policy compilation failed")
+		}
+	}
+	compiler, err := compileModules(parsed)
 	if err != nil {
-		return nil, nil, errors.Wrapf(err, "policy compilation failed")
+		return nil, nil, err
 	}
 
-	// Buld up a list of rules.
-	var packName string
+	// Buld up a list of rules. Rules are only policies if they are in the manifest's root package or one of its
+	// subpackages; all other packages are libraries, used as routines in authoring the policies.
+	annotations := compiler.GetAnnotationSet()
 	var policies []*policyRule
-	for name, module := range compiler.Modules {
-		// First determine the package name. This should match for all rules.
+	var policyPkgs, allPkgs, warnings []string
+	entrypoints := make(map[string]*entrypoint)
+	for i := range manifest.Entrypoints {
+		entry := &manifest.Entrypoints[i]
+		entrypoints[entry.pkg+"."+entry.rule] = entry
+	}
+	names := make([]string, 0, len(compiler.Modules))
+	for name := range compiler.Modules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		module := compiler.Modules[name]
 		pkg := module.Package.String()
 		if strings.Index(pkg, "package ") != 0 {
 			return nil, nil, errors.Errorf("malformed package name, expected 'package' prefix: %s", pkg)
 		}
 		pkg = pkg[len("package "):]
-		if packName == "" {
-			packName = pkg
-		} else if packName != pkg {
-			return nil, nil, errors.Errorf("unexpected package name differences: got %s, expected %s", pkg, packName)
+		allPkgs = append(allPkgs, pkg)
+		if !inPackage(pkg, manifest.Root) {
+			continue
 		}
 
 		// Next go through all rules and tease them apart, skipping duplicates.
@@ -97,14 +181,23 @@ func loadPolicyPack(dir string) (*policyPack, *evaler, error) {
 		for _, rule := range module.Rules {
 			ruleName := rule.Head.Name.String()
 
-			// Only process those that are legitimate errors or warnings. Other "rules" are
-			// actually just libraries that can be used as routines in authoring other rules.
-			var level enforcementLevel
-			if denyRulePrefix.MatchString(ruleName) {
-				level = mandatoryRule
-			} else if warnRulePrefix.MatchString(ruleName) {
-				level = advisoryRule
-			} else {
+			// Only process those that are legitimate errors or warnings, or that are annotated as policies.
+			// Other "rules" are actually just libraries that can be used as routines in authoring other rules.
+			// Entrypoints are added below.
+			level, kind, isPolicy := manifest.patterns.classify(ruleName)
+			if !isPolicy && len(rule.Head.Args) == 0 && optsIn(ruleAnnotations(annotations, rule)) {
+				level, kind, isPolicy = mandatoryRule, resourcePolicy, true // unless its annotations say otherwise
+			}
+			if _, isEntrypoint := entrypoints[pkg+"."+ruleName]; isEntrypoint {
+				continue
+			}
+			if !isPolicy {
+				if policyLikeName.MatchString(ruleName) && !existing[ruleName] {
+					existing[ruleName] = true
+					warnings = append(warnings, fmt.Sprintf("%s: rule %s looks like a policy, but its name matches "+
+						"no policy pattern, so it is only a library rule; rename it or make it an entrypoint",
+						rule.Location, ruleName))
+				}
 				continue // skip
 			}
 
@@ -113,31 +206,234 @@ func loadPolicyPack(dir string) (*policyPack, *evaler, error) {
 				policies = append(policies, &policyRule{
 					Name:        ruleName,
 					DisplayName: name,
-					// TODO: Description, Message
-					Level: level,
+					Level:       level,
+					Kind:        kind,
+					pkg:         pkg,
+					rule:        ruleName,
+					file:        name,
 				})
+				policyPkgs = append(policyPkgs, pkg)
 			}
 		}
 	}
 
-	// Create the resulting policy pack metadata.
-	pack := &policyPack{
-		Name: packName,
-		// TODO: DisplayName
-		Policies: policies,
+	// Entrypoints are policies whatever their names and packages.
+	explicitLevels := make(map[*policyRule]enforcementLevel)
+	for _, entry := range manifest.Entrypoints {
+		rules := compiler.GetRulesExact(ast.MustParseRef(entry.Query))
+		if len(rules) == 0 {
+			return nil, nil, manifest.errorf([]string{"entrypoints"}, "entrypoint %s is not a rule", entry.Query)
+		}
+		policy := &policyRule{
+			Name:        entry.rule,
+			DisplayName: rules[0].Location.File,
+			Level:       entry.level,
+			Kind:        entry.kind,
+			pkg:         entry.pkg,
+			rule:        entry.rule,
+		}
+		if entry.EnforcementLevel != "" {
+			explicitLevels[policy] = entry.level
+		}
+		policies = append(policies, policy)
+		policyPkgs = append(policyPkgs, entry.pkg)
+	}
+
+	// A rule defined in several files is a separate policy in each of them, so that each file's violations are
+	// attributed to that file. Rego merges the definitions into a single document, so each file's definitions are
+	// copied into a rule of their own to be evaluated apart from the others.
+	definitions := make(map[string]int)
+	for _, policy := range policies {
+		if policy.file != "" {
+			definitions[policy.pkg+"."+policy.rule]++
+		}
+	}
+	var split bool
+	for _, policy := range policies {
+		if policy.file != "" && definitions[policy.pkg+"."+policy.rule] > 1 {
+			policy.rule, policy.split, split = splitRule(parsed[policy.file], policy.rule), true, true
+		}
+	}
+	if split {
+		if compiler, err = compileModules(parsed); err != nil {
+			return nil, nil, err
+		}
+		annotations = compiler.GetAnnotationSet()
 	}
 
-	// Make an evaluator that can actually apply the rules using the above compiler.
-	e := &evaler{c: compiler}
+	// Policies are named after the file they are found in and their fully qualified package, like
+	// s3/buckets.rego:aws.s3.deny, so that adding a file or a package never renames the policies in others. Files are
+	// set apart by a colon, which package paths can't contain. Entrypoints are named after their package alone.
+	if !manifest.PlainNames {
+		for _, policy := range policies {
+			policy.Name = policy.pkg + "." + policy.Name
+			if policy.file != "" {
+				policy.Name = filepath.ToSlash(policy.file) + ".rego:" + policy.Name
+			}
+		}
+	}
 
-	return pack, e, nil
+	// Apply any per-rule metadata from the rules' annotations and then the manifest, and work out which parts of
+	// the input each rule reads so that rules touching unknown values can be handled according to the pack's
+	// unknowns policy.
+	known := make(map[string]bool)
+	for _, policy := range policies {
+		if known[policy.Name] {
+			if manifest.PlainNames {
+				return nil, nil, errors.Errorf("more than one policy is named %s; remove plainNames from %s to name "+
+					"policies after their files and packages", policy.Name, manifestFile)
+			}
+			return nil, nil, errors.Errorf("more than one policy is named %s", policy.Name)
+		}
+		known[policy.Name] = true
+		rules := policy.definitions(compiler)
+
+		annotated := ruleAnnotations(annotations, rules...)
+		if policy.split {
+			// Document annotations describe the rule as a whole, wherever it is defined; keep only those from the
+			// policy's own file, so that one file's annotations don't describe another's policy.
+			own := annotated[:0]
+			for _, a := range annotated {
+				if a.Location != nil && a.Location.File == policy.file {
+					own = append(own, a)
+				}
+			}
+			annotated = own
+		}
+		if err := policy.applyAnnotations(annotated); err != nil {
+			return nil, nil, err
+		}
+		if level, has := explicitLevels[policy]; has {
+			policy.Level = level
+		}
+
+		settings := manifest.Rules[policy.Name]
+		if settings.DisplayName != "" {
+			policy.DisplayName = settings.DisplayName
+		}
+		if settings.Description != "" {
+			policy.Description = settings.Description
+		}
+		if settings.Message != "" {
+			policy.Message = settings.Message
+		}
+		if settings.EnforcementLevel != "" {
+			policy.Level, _ = parseEnforcementLevel(settings.EnforcementLevel)
+		}
+		policy.Timeout = manifest.Timeouts.rule
+		if settings.timeout != 0 {
+			policy.Timeout = settings.timeout
+		}
+		policy.Unknowns = manifest.Unknowns
+		if settings.Unknowns != "" {
+			policy.Unknowns = settings.Unknowns
+		}
+		policy.reads = inputReads(compiler, rules)
+		if err := policy.checkDefaultInput(manifest); err != nil {
+			return nil, nil, err
+		}
+
+		policy.Compliance = settings.Compliance
+		if policy.Compliance == nil {
+			if policy.Compliance, err = annotatedComplianceControls(annotated); err != nil {
+				return nil, nil, errors.Wrapf(err, "rule %s", policy.Name)
+			}
+		}
+
+		// Rules may declare a schema for their configuration in the manifest or in their annotations.
+		policy.ConfigSchema = settings.Config
+		if policy.ConfigSchema == nil {
+			if policy.ConfigSchema, err = annotatedConfigSchema(annotated); err != nil {
+				return nil, nil, err
+			}
+		}
+		if policy.ConfigSchema != nil {
+			if policy.config, err = policy.ConfigSchema.compile(); err != nil {
+				return nil, nil, errors.Wrapf(err, "invalid config schema for rule %s", policy.Name)
+			}
+		}
+	}
+	for name := range manifest.Rules {
+		if !known[name] {
+			return nil, nil, manifest.errorf([]string{"rules", name}, "settings given for unknown rule %s", name)
+		}
+	}
+
+	// Create the resulting policy pack metadata. The pack is named after its root package unless the manifest
+	// names it. Without a root, that's the package its policies have in common.
+	packName := manifest.Name
+	if packName == "" {
+		packName = manifest.Root
+	}
+	if packName == "" {
+		if len(policyPkgs) == 0 {
+			policyPkgs = allPkgs
+		}
+		packName = commonPackage(policyPkgs)
+		if packName == "" && len(policyPkgs) > 0 {
+			return nil, nil, errors.Errorf("policies are defined in unrelated packages %s; name the pack in %s",
+				strings.Join(uniqueStrings(policyPkgs), ", "), manifestFile)
+		}
+	}
+	pack := &policyPack{
+		Name:            packName,
+		DisplayName:     manifest.DisplayName,
+		Version:         manifest.Version,
+		Description:     manifest.Description,
+		Policies:        policies,
+		Input:           manifest.Input,
+		Parallelism:     manifest.Parallelism,
+		Cache:           manifest.Cache,
+		ResourceTimeout: manifest.Timeouts.resource,
+		Hash:            contentHash(modules, manifest.raw),
+		warnings:        warnings,
+	}
+	return pack, compiler, nil
 }
 
 // policyPack holds the metadata for a complete Pulumi policy package.
 type policyPack struct {
 	Name        string        `json:"name"`
 	DisplayName string        `json:"displayName"`
+	Version     string        `json:"version"`
+	Description string        `json:"description"`
 	Policies    []*policyRule `json:"policies"`
+	Input       inputSettings `json:"input"`
+	// Parallelism is the most queries evaluated at once, which defaults to the number of CPUs.
+	Parallelism int `json:"parallelism"`
+	// Cache configures the cache of results from earlier runs.
+	Cache cacheSettings `json:"cache"`
+	// ResourceTimeout bounds the evaluation of all of the rules against a resource or stack, if it is non-zero.
+	ResourceTimeout time.Duration `json:"resourceTimeout"`
+	// Hash is the SHA-256 of the pack's content, its Rego modules and manifest, identifying exactly which rules ran.
+	Hash string `json:"hash"`
+
+	warnings []string // problems with the pack that don't stop it from loading, like misnamed rules.
+}
+
+// version returns the pack's version. Packs without a version in their manifest are versioned by their content,
+// like 0.0.0+sha256.1a2b3c4d5e6f, so that every revision of a pack is told apart.
+func (p *policyPack) version() string {
+	if p.Version != "" {
+		return p.Version
+	}
+	return "0.0.0+sha256." + p.Hash[:12]
+}
+
+// contentHash returns the hex SHA-256 of a pack's Rego modules, keyed by their paths, and the raw manifest.
+func contentHash(modules map[string]string, manifest []byte) string {
+	names := make([]string, 0, len(modules))
+	for name := range modules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(h, "%s\x00%d\x00%s", name, len(modules[name]), modules[name])
+	}
+	fmt.Fprintf(h, "%s\x00%d\x00%s", manifestFile, len(manifest), manifest)
+	return hex.EncodeToString(h.Sum(nil))
 }
 
 // policyRule holds the metadata for a Pulumi policy rule, in addition to the OPA rule authored in *.rego.
@@ -147,11 +443,199 @@ type policyRule struct {
 	Description string           `json:"description"`
 	Message     string           `json:"message"`
 	Level       enforcementLevel `json:"enforcementLevel"`
+	Unknowns    unknownsPolicy   `json:"unknowns"`
+	Kind        policyKind       `json:"type"`
+	// Severity is how serious a violation of the rule is, if the rule's annotations say.
+	Severity apitype.PolicySeverity `json:"severity,omitempty"`
+	// ConfigSchema describes the configuration the rule accepts, if it is configurable.
+	ConfigSchema *configSchema `json:"configSchema,omitempty"`
+	// Compliance lists the compliance controls the rule covers.
+	Compliance complianceControls `json:"compliance,omitempty"`
+	// Timeout bounds each evaluation of the rule, if it is non-zero.
+	Timeout time.Duration `json:"timeout,omitempty"`
+
+	pkg    string             // the Rego package the rule is defined in.
+	rule   string             // the Rego rule queried for the policy's results.
+	file   string             // the module the policy was found in, unless it is an entrypoint.
+	split  bool               // whether the rule is split between modules, and file's definitions copied apart.
+	reads  []inputPath        // the parts of the input document the rule reads.
+	config *jsonschema.Schema // validates the rule's configuration, if it has a ConfigSchema.
+}
+
+// ref returns the reference to the document the rule defines, like `data.aws.s3.deny`.
+func (p *policyRule) ref() string {
+	return fmt.Sprintf("data.%s.%s", p.pkg, p.rule)
+}
+
+// definitions returns the definitions of the rule. For rules split between modules, these are the definitions in
+// the policy's own module, as authored, rather than the copies that are evaluated.
+func (p *policyRule) definitions(compiler *ast.Compiler) []*ast.Rule {
+	if !p.split {
+		return compiler.GetRules(ast.MustParseRef(p.ref()))
+	}
+
+	var rules []*ast.Rule
+	for _, rule := range compiler.Modules[p.file].Rules {
+		if splitRuleName(p.file, rule.Head.Name.String()) == p.rule {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// compileModules compiles a pack's parsed modules.
+func compileModules(modules map[string]*ast.Module) (*ast.Compiler, error) {
+	compiler := ast.NewCompiler().WithDefaultRegoVersion(ast.RegoV0)
+	compiler.Compile(modules)
+	if compiler.Failed() {
+		return nil, errors.Wrapf(compiler.Errors, "policy compilation failed")
+	}
+	return compiler, nil
+}
+
+// splitRule copies the definitions of a rule in a module into a rule of their own, so that they can be evaluated
+// apart from those in other modules, and returns the new rule's name.
+func splitRule(module *ast.Module, ruleName string) string {
+	name := splitRuleName(module.Package.Location.File, ruleName)
+	var copies []*ast.Rule
+	for _, rule := range module.Rules {
+		if rule.Head.Name.String() != ruleName {
+			continue
+		}
+		c := rule.Copy()
+		c.Annotations = nil
+		for r := c; r != nil; r = r.Else {
+			r.Head.Name = ast.Var(name)
+			r.Head.Reference = ast.Ref{ast.VarTerm(name)}
+		}
+		copies = append(copies, c)
+	}
+	module.Rules = append(module.Rules, copies...)
+	return name
 }
 
+// splitRuleName returns the name of the rule that holds a module's definitions of a split rule.
+func splitRuleName(file, ruleName string) string {
+	return "__pulumi_" + nonIdentifierChars.ReplaceAllString(file, "_") + "_" + ruleName
+}
+
+// nonIdentifierChars matches the characters that may not appear in Rego identifiers.
+var nonIdentifierChars = regexp.MustCompile("[^a-zA-Z0-9_]")
+
+// defaultMessage is the message reported for a violation of the rule when the rule doesn't give one.
+func (p *policyRule) defaultMessage() string {
+	switch {
+	case p.Message != "":
+		return p.Message
+	case p.Description != "":
+		return p.Description
+	default:
+		return p.DisplayName
+	}
+}
+
+// inPackage returns true if pkg is the root package or one of its subpackages. Every package is in the empty root.
+func inPackage(pkg, root string) bool {
+	return root == "" || pkg == root || strings.HasPrefix(pkg, root+".")
+}
+
+// commonPackage returns the innermost package that all of the given packages are in, or "" if they have none.
+func commonPackage(pkgs []string) string {
+	var common []string
+	for i, pkg := range pkgs {
+		parts := strings.Split(pkg, ".")
+		if i == 0 {
+			common = parts
+			continue
+		}
+		n := 0
+		for n < len(common) && n < len(parts) && common[n] == parts[n] {
+			n++
+		}
+		common = common[:n]
+	}
+	return strings.Join(common, ".")
+}
+
+// uniqueStrings returns the distinct strings in ss, sorted.
+func uniqueStrings(ss []string) []string {
+	seen := make(map[string]bool)
+	var result []string
+	for _, s := range ss {
+		if !seen[s] {
+			seen[s] = true
+			result = append(result, s)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// policyKind distinguishes rules evaluated once per resource from those evaluated once per stack, and from
+// those that remediate resources.
+type policyKind int
+
+const (
+	resourcePolicy    policyKind = 0
+	stackPolicy       policyKind = 1
+	remediationPolicy policyKind = 2
+)
+
 type enforcementLevel int
 
 const (
 	advisoryRule  enforcementLevel = 0
 	mandatoryRule enforcementLevel = 1
+	remediateRule enforcementLevel = 2
+	// disabledRule rules are never evaluated. No rule name implies it; rules are disabled through the manifest
+	// or their configuration.
+	disabledRule enforcementLevel = 3
 )
+
+// apiType returns the enforcement level as Pulumi knows it.
+func (l enforcementLevel) apiType() apitype.EnforcementLevel {
+	switch l {
+	case advisoryRule:
+		return apitype.Advisory
+	case remediateRule:
+		return apitype.Remediate
+	case disabledRule:
+		return apitype.Disabled
+	default:
+		return apitype.Mandatory
+	}
+}
+
+// parseEnforcementLevel is the inverse of enforcementLevel.apiType.
+func parseEnforcementLevel(level apitype.EnforcementLevel) (enforcementLevel, error) {
+	switch level {
+	case apitype.Advisory:
+		return advisoryRule, nil
+	case apitype.Mandatory:
+		return mandatoryRule, nil
+	case apitype.Remediate:
+		return remediateRule, nil
+	case apitype.Disabled:
+		return disabledRule, nil
+	default:
+		return 0, errors.Errorf("unknown enforcement level %q, expected one of advisory, disabled, mandatory, remediate",
+			level)
+	}
+}
+
+// checkDefaultInput makes sure that a resource rule in a pack that doesn't choose an input format reads the resource
+// input envelope. Packs written against bare properties, from before the envelope existed, would otherwise load
+// fine, but rules like `input.acl == "public-read"` would silently never be violated.
+func (p *policyRule) checkDefaultInput(manifest *policyManifest) error {
+	if !manifest.defaultInput || len(manifest.Input.Providers) > 0 || p.Kind == stackPolicy {
+		return nil
+	}
+	for _, path := range p.reads {
+		if len(path) > 0 && !isResourceInputKey(path[0]) {
+			return errors.Errorf("rule %s reads input.%s, which is not part of the resource input; properties are "+
+				"under input.properties, or set `input: {format: properties}` in %s for rules written against bare "+
+				"properties", p.Name, path[0], manifestFile)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+// Copyright 2025, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource/plugin"
+)
+
+// redactedSecret replaces secret values in diagnostics, matching how the Pulumi CLI displays secrets.
+const redactedSecret = "[secret]"
+
+// unknownValue stands in for every value that is not known yet, such as the outputs of resources that have not
+// been created during a preview. It is the same sentinel the Pulumi engine uses for unknown strings, and rules
+// can test for it with the pulumi.is_unknown and pulumi.has_unknowns builtins.
+const unknownValue = plugin.UnknownStringValue
+
+// propertyConverter turns Pulumi property values into the plain values that Rego works with. Secrets are presented
+// in plaintext so that rules can inspect them, but the converter remembers each one so that the paths of secret
+// properties can be given to rules and the secret values scrubbed from anything the analyzer reports. Unknown
+// values are replaced by unknownValue, and their paths given to rules as well.
+type propertyConverter struct {
+	secrets map[string]bool // the plaintext of every secret string converted so far.
+	scalars map[string]bool // the JSON of every secret number and bool converted so far.
+}
+
+// convertedProperties holds a converted property map along with the paths of the secret and unknown values inside
+// it, in the property path syntax used by ignoreChanges (e.g. `password` or `tags["api-key"]`).
+type convertedProperties struct {
+	values   map[string]any
+	secrets  []any
+	unknowns []any
+}
+
+func newPropertyConverter() *propertyConverter {
+	return &propertyConverter{secrets: make(map[string]bool), scalars: make(map[string]bool)}
+}
+
+// convertProperties converts a property map. Any top-level keys given in secretKeys, such as a resource's
+// additionalSecretOutputs, are treated as secret.
+func (c *propertyConverter) convertProperties(
+	props resource.PropertyMap,
+	secretKeys ...resource.PropertyKey,
+) convertedProperties {
+	forced := make(map[resource.PropertyKey]bool)
+	for _, k := range secretKeys {
+		forced[k] = true
+	}
+
+	result := convertedProperties{
+		values:   make(map[string]any),
+		secrets:  []any{},
+		unknowns: []any{},
+	}
+	for _, k := range props.StableKeys() {
+		path := resource.PropertyPath{string(k)}
+		result.values[string(k)] = c.convert(props[k], path, path, forced[k], &result)
+	}
+	return result
+}
+
+// convert converts a single property value found at path. secretPath is the same as path until the value is
+// found to be secret, after which it is nil: only the outermost secret is recorded, and everything beneath it
+// is implicitly secret.
+func (c *propertyConverter) convert(
+	v resource.PropertyValue,
+	path resource.PropertyPath,
+	secretPath resource.PropertyPath,
+	secret bool,
+	result *convertedProperties,
+) any {
+	if secret && secretPath != nil {
+		result.secrets = append(result.secrets, secretPath.String())
+		secretPath = nil
+	}
+
+	switch {
+	case v.IsSecret():
+		return c.convert(v.SecretValue().Element, path, secretPath, true, result)
+	case v.IsOutput() && v.OutputValue().Known:
+		return c.convert(v.OutputValue().Element, path, secretPath, secret || v.OutputValue().Secret, result)
+	case v.IsComputed() || v.IsOutput():
+		result.unknowns = append(result.unknowns, path.String())
+		return unknownValue
+	case v.IsString():
+		if secret && v.StringValue() != "" {
+			c.secrets[v.StringValue()] = true
+		}
+		return v.StringValue()
+	case v.IsNumber() || v.IsBool():
+		if secret {
+			if b, err := json.Marshal(v.Mappable()); err == nil {
+				c.scalars[string(b)] = true
+			}
+		}
+		return v.Mappable()
+	case v.IsArray():
+		arr := []any{}
+		for i, e := range v.ArrayValue() {
+			arr = append(arr, c.convert(e, childPath(path, i), childPath(secretPath, i), secret, result))
+		}
+		return arr
+	case v.IsObject():
+		obj := make(map[string]any)
+		for _, k := range v.ObjectValue().StableKeys() {
+			key := string(k)
+			obj[key] = c.convert(v.ObjectValue()[k], childPath(path, key), childPath(secretPath, key), secret, result)
+		}
+		return obj
+	default:
+		return v.Mappable()
+	}
+}
+
+// childPath extends a path with a key or index. A nil path stays nil.
+func childPath(path resource.PropertyPath, key any) resource.PropertyPath {
+	if path == nil {
+		return nil
+	}
+	child := make(resource.PropertyPath, len(path), len(path)+1)
+	copy(child, path)
+	return append(child, key)
+}
+
+// hasSecrets returns true if the converter has seen any secret values.
+func (c *propertyConverter) hasSecrets() bool {
+	return c != nil && (len(c.secrets) > 0 || len(c.scalars) > 0)
+}
+
+// redact scrubs every secret value the converter has seen from msg. Longer secrets are replaced first so that a
+// secret containing another is not left partially exposed, and JSON-escaped forms are scrubbed as well since
+// rules commonly format whole objects into their messages. Secret numbers and bools are only scrubbed where they
+// stand alone, like the 8080 in `port 8080`, so that a secret like 80 or true doesn't garble the rest of the message.
+func (c *propertyConverter) redact(msg string) string {
+	if !c.hasSecrets() {
+		return msg
+	}
+
+	var secrets []string
+	for s := range c.secrets {
+		secrets = append(secrets, s)
+		if b, err := json.Marshal(s); err == nil {
+			if escaped := string(b[1 : len(b)-1]); escaped != s {
+				secrets = append(secrets, escaped)
+			}
+		}
+	}
+	sortLongestFirst(secrets)
+	for _, s := range secrets {
+		msg = strings.ReplaceAll(msg, s, redactedSecret)
+	}
+
+	scalars := make([]string, 0, len(c.scalars))
+	for s := range c.scalars {
+		scalars = append(scalars, s)
+	}
+	sortLongestFirst(scalars)
+	for _, s := range scalars {
+		msg = replaceToken(msg, s, redactedSecret)
+	}
+	return msg
+}
+
+// sortLongestFirst sorts strings by length, longest first, and then alphabetically.
+func sortLongestFirst(s []string) {
+	sort.Slice(s, func(i, j int) bool {
+		if len(s[i]) != len(s[j]) {
+			return len(s[i]) > len(s[j])
+		}
+		return s[i] < s[j]
+	})
+}
+
+// replaceToken replaces the occurrences of old in s that aren't part of a longer word or number.
+func replaceToken(s, old, new string) string {
+	var b strings.Builder
+	for {
+		i := strings.Index(s, old)
+		if i == -1 {
+			b.WriteString(s)
+			return b.String()
+		}
+		end := i + len(old)
+		if (i > 0 && isTokenChar(s[i-1])) || (end < len(s) && isTokenChar(s[end])) {
+			b.WriteString(s[:i+1])
+			s = s[i+1:]
+			continue
+		}
+		b.WriteString(s[:i])
+		b.WriteString(new)
+		s = s[end:]
+	}
+}
+
+// isTokenChar returns true for the characters that words and numbers are made of.
+func isTokenChar(c byte) bool {
+	return c == '_' || ('0' <= c && c <= '9') || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
@@ -0,0 +1,198 @@
+// Copyright 2025, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/open-policy-agent/opa/v1/rego"
+	"github.com/pkg/errors"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource/plugin"
+)
+
+// remediatePolicyPack evaluates the pack's remediation rules against a resource in order, each seeing the resource
+// as left by the rules before it. A remediation rule is a complete rule whose value is either the resource's new
+// properties in full, or a JSON Patch (RFC 6902) to apply to its current properties:
+//
+//	remediate_tags = [{"op": "add", "path": "/tags/owner", "value": "platform"}] {
+//	    input.type == "aws:s3/bucket:Bucket"
+//	    not input.properties.tags.owner
+//	}
+//
+// Either way the value is relative to the resource's properties, which are input.properties in the resource input
+// format, input.request.object in the kubernetes-admission format, and input itself, less its reserved keys, in the
+// properties format. Rules that are undefined for the resource, or that leave its properties unchanged, produce no
+// remediation.
+//
+// When remediating, only rules at the remediate enforcement level are evaluated. Otherwise only those at the
+// advisory and mandatory levels are, each against the resource as it is, so that the remediations they would make
+// can be reported as violations instead.
+func (e *evaler) remediatePolicyPack(
+	ctx context.Context,
+	pack *policyPack,
+	r plugin.AnalyzerResource,
+	remediating bool,
+) ([]remediationResult, error) {
+	var results []remediationResult
+	s := e.state.Load()
+	for _, rule := range pack.Policies {
+		level := s.level(rule)
+		if rule.Kind != remediationPolicy || level == disabledRule || (level == remediateRule) != remediating {
+			continue
+		}
+
+		input, _ := newResourceInput(r, pack.Input)
+		if rule.Unknowns != evaluateUnknowns {
+			if result, has := unknownsResult(pack, rule, level, findUnknowns(input)); has {
+				if result != nil {
+					results = append(results, remediationResult{
+						pack:          pack.Name,
+						rule:          rule.Name,
+						level:         level,
+						notApplicable: result.msg,
+					})
+				}
+				continue
+			}
+		}
+
+		ruleCtx, cancel := withTimeout(ctx, rule.Timeout)
+		resultSet, err := s.queries[rule].Eval(ruleCtx, rego.EvalInput(input))
+		cancel()
+		if err != nil {
+			// A rule that runs out of time doesn't remediate the resource, but the rest may still be applied.
+			var reason string
+			switch {
+			case ctx.Err() == context.DeadlineExceeded:
+				reason = fmt.Sprintf("rule %s did not finish before the time allowed for the resource ran out", rule.Name)
+			case ctx.Err() != nil:
+				return nil, errors.Wrap(ctx.Err(), "evaluation canceled")
+			case ruleCtx.Err() == context.DeadlineExceeded:
+				reason = fmt.Sprintf("rule %s timed out after %v", rule.Name, rule.Timeout)
+			default:
+				return nil, errors.Wrapf(err, "evaluating rule %s", rule.ref())
+			}
+			results = append(results, remediationResult{pack: pack.Name, rule: rule.Name, level: level, notApplicable: reason})
+			continue
+		}
+		if len(resultSet) == 0 || len(resultSet[0].Expressions) == 0 {
+			continue
+		}
+
+		// Work out the new properties from the rule's value, restoring the secret and unknown values that were
+		// lost when the properties were presented to the rule.
+		props := newPropertyConverter().convertProperties(r.Properties, r.Options.AdditionalSecretOutputs...)
+		var values any
+		switch v := resultSet[0].Expressions[0].Value.(type) {
+		case map[string]any:
+			values = v
+		case []any:
+			if values, err = e.applyPatch(ctx, props.values, v); err != nil {
+				return nil, errors.Wrapf(err, "applying patch from rule %s", rule.ref())
+			}
+		default:
+			return nil, errors.Errorf("rule %s must produce an object of properties or a JSON Patch, got %v",
+				rule.ref(), v)
+		}
+		obj, ok := values.(map[string]any)
+		if !ok {
+			return nil, errors.Errorf("rule %s produced properties that are not an object: %v",
+				rule.ref(), values)
+		}
+		if pack.Input.formatFor(r) == propertiesInput {
+			restoreReservedKeys(obj, props.values)
+		}
+		properties := restoreProperties(obj, props.secrets)
+		if properties.DeepEquals(r.Properties) {
+			continue
+		}
+
+		results = append(results, remediationResult{pack: pack.Name, rule: rule.Name, level: level, properties: properties})
+		if remediating {
+			r.Properties = properties
+		}
+	}
+	return results, nil
+}
+
+// applyPatch applies a JSON Patch to a document using OPA's own json.patch builtin, so that patches behave exactly
+// as they would if a rule applied them itself.
+func (e *evaler) applyPatch(ctx context.Context, doc any, patch []any) (any, error) {
+	resultSet, err := e.patch.Eval(ctx, rego.EvalInput(map[string]any{"doc": doc, "patch": patch}))
+	if err != nil {
+		return nil, err
+	}
+	if len(resultSet) == 0 {
+		return nil, errors.Errorf("patch %v cannot be applied", patch)
+	}
+	return resultSet[0].Bindings["result"], nil
+}
+
+// restoreReservedKeys undoes what the properties input format mixes into a resource's properties, which rules
+// copy into their values when they build on the whole input, as in `object.union(input, {"acl": "private"})`. Each
+// reserved key is given back the value of the property it hid, or removed if there was no such property.
+func restoreReservedKeys(values, original map[string]any) {
+	for _, key := range propertiesReservedKeys {
+		if v, has := original[key]; has {
+			values[key] = v
+		} else {
+			delete(values, key)
+		}
+	}
+}
+
+// restoreProperties turns the plain values a rule produced back into Pulumi properties, marking the properties at
+// the given secret paths as secret and turning unknownValue back into unknown values.
+func restoreProperties(values map[string]any, secrets []any) resource.PropertyMap {
+	props := resource.NewPropertyMapFromMapRepl(values, nil, func(v any) (resource.PropertyValue, bool) {
+		switch v := v.(type) {
+		case json.Number:
+			f, err := v.Float64()
+			if err != nil {
+				return resource.PropertyValue{}, false
+			}
+			return resource.NewNumberProperty(f), true
+		case string:
+			if v == unknownValue {
+				return resource.MakeComputed(resource.NewStringProperty("")), true
+			}
+		}
+		return resource.PropertyValue{}, false
+	})
+
+	root := resource.NewObjectProperty(props)
+	for _, s := range secrets {
+		path, err := resource.ParsePropertyPath(s.(string))
+		if err != nil {
+			continue
+		}
+		if v, has := path.Get(root); has && !v.IsSecret() {
+			path.Set(root, resource.MakeSecret(v))
+		}
+	}
+	return props
+}
+
+type remediationResult struct {
+	pack       string
+	rule       string
+	level      enforcementLevel
+	properties resource.PropertyMap // the resource's properties after the remediation.
+	// notApplicable is set when the rule was not evaluated because it reads unknown values, and explains why.
+	notApplicable string
+}
@@ -0,0 +1,134 @@
+// Copyright 2025, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/open-policy-agent/opa/v1/ast"
+	"github.com/pkg/errors"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource/plugin"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// configSchemaKey is the key under an OPA `# METADATA` annotation's `custom` section that declares a rule's
+// configuration schema, and under a rule's settings in the manifest:
+//
+//	# METADATA
+//	# custom:
+//	#   config:
+//	#     properties:
+//	#       maxSizeGb:
+//	#         type: integer
+//	#         default: 100
+//	#     required: [maxSizeGb]
+//	deny_bucket_size[msg] { ... }
+const configSchemaKey = "config"
+
+// configSchema describes the configuration properties a rule accepts, each with a JSON schema of its own.
+type configSchema struct {
+	Properties map[string]map[string]any `yaml:"properties" json:"properties,omitempty"`
+	Required   []string                  `yaml:"required" json:"required,omitempty"`
+}
+
+// annotatedConfigSchema returns the configuration schema declared by a rule's `# METADATA` annotations, if any.
+func annotatedConfigSchema(annotations []*ast.Annotations) (*configSchema, error) {
+	for _, a := range annotations {
+		raw, has := a.Custom[configSchemaKey]
+		if !has {
+			continue
+		}
+
+		// Round trip through JSON to turn the annotation's loosely typed YAML into a schema.
+		b, err := json.Marshal(raw)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s: reading config schema", a.Location)
+		}
+		var schema configSchema
+		if err := json.Unmarshal(b, &schema); err != nil {
+			return nil, errors.Wrapf(err, "%s: reading config schema", a.Location)
+		}
+		return &schema, nil
+	}
+	return nil, nil
+}
+
+// compile compiles the schema into a validator for configuration objects.
+func (s *configSchema) compile() (*jsonschema.Schema, error) {
+	doc := map[string]any{"type": "object"}
+	if len(s.Properties) > 0 {
+		doc["properties"] = s.Properties
+	}
+	if len(s.Required) > 0 {
+		doc["required"] = s.Required
+	}
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	return jsonschema.CompileString("config.json", string(b))
+}
+
+// apiType returns the schema as Pulumi knows it.
+func (s *configSchema) apiType() *plugin.AnalyzerPolicyConfigSchema {
+	props := make(map[string]plugin.JSONSchema)
+	for name, prop := range s.Properties {
+		props[name] = prop
+	}
+	return &plugin.AnalyzerPolicyConfigSchema{Properties: props, Required: s.Required}
+}
+
+// defaults returns the default value of every property that has one.
+func (s *configSchema) defaults() map[string]any {
+	defaults := make(map[string]any)
+	for name, prop := range s.Properties {
+		if v, has := prop["default"]; has {
+			defaults[name] = v
+		}
+	}
+	return defaults
+}
+
+// configErrors describes every problem a validator found with a configuration object, one per field.
+func configErrors(err error) string {
+	var verr *jsonschema.ValidationError
+	if !errors.As(err, &verr) {
+		return err.Error()
+	}
+
+	var msgs []string
+	var walk func(e *jsonschema.ValidationError)
+	walk = func(e *jsonschema.ValidationError) {
+		if len(e.Causes) > 0 {
+			for _, cause := range e.Causes {
+				walk(cause)
+			}
+			return
+		}
+		field := strings.ReplaceAll(strings.TrimPrefix(e.InstanceLocation, "/"), "/", ".")
+		if field == "" {
+			msgs = append(msgs, e.Message)
+		} else {
+			msgs = append(msgs, fmt.Sprintf("%s: %s", field, e.Message))
+		}
+	}
+	walk(verr)
+
+	sort.Strings(msgs)
+	return strings.Join(msgs, "; ")
+}
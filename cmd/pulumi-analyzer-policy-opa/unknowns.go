@@ -0,0 +1,156 @@
+// Copyright 2025, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/open-policy-agent/opa/v1/ast"
+)
+
+// unknownsPolicy decides what happens to a rule when input it reads is unknown, as happens during previews.
+type unknownsPolicy string
+
+const (
+	// evaluateUnknowns evaluates the rule regardless, with unknown values presented as unknownValue.
+	evaluateUnknowns unknownsPolicy = "evaluate"
+	// skipUnknowns silently skips the rule.
+	skipUnknowns unknownsPolicy = "skip"
+	// deferUnknowns skips the rule and reports it as not applicable, so that it is evaluated once values are known.
+	deferUnknowns unknownsPolicy = "defer"
+	// failUnknowns reports a violation at the rule's enforcement level without evaluating it.
+	failUnknowns unknownsPolicy = "fail"
+)
+
+// knownUnknownsPolicies lists the valid unknowns policies for use in error messages.
+const knownUnknownsPolicies = "defer, evaluate, fail, skip"
+
+func (p unknownsPolicy) isValid() bool {
+	switch p {
+	case evaluateUnknowns, skipUnknowns, deferUnknowns, failUnknowns:
+		return true
+	}
+	return false
+}
+
+// inputPath is a path into the input document, e.g. ["properties", "acl"].
+type inputPath []string
+
+func (p inputPath) String() string {
+	return strings.Join(p, ".")
+}
+
+// overlaps reports whether either path is a prefix of the other, i.e. whether reading one reads the other.
+func (p inputPath) overlaps(other inputPath) bool {
+	n := min(len(p), len(other))
+	for i := 0; i < n; i++ {
+		if p[i] != other[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// inputReads statically determines which parts of the input document the given rules read, following references
+// to other rules and functions in the pack. Each reference to input contributes the longest prefix made up of
+// constant keys, so `input.properties.ingress[_].cidr` reads `properties.ingress`, and any reference that is not
+// constant at all reads the entire document.
+func inputReads(c *ast.Compiler, rules []*ast.Rule) []inputPath {
+	seen := make(map[*ast.Rule]bool)
+	paths := make(map[string]inputPath)
+
+	queue := append([]*ast.Rule(nil), rules...)
+	for len(queue) > 0 {
+		rule := queue[0]
+		queue = queue[1:]
+		if seen[rule] {
+			continue
+		}
+		seen[rule] = true
+
+		ast.WalkRefs(rule, func(ref ast.Ref) bool {
+			if !ref[0].Equal(ast.InputRootDocument) {
+				return false
+			}
+			var path inputPath
+			for _, t := range ref[1:] {
+				s, ok := t.Value.(ast.String)
+				if !ok {
+					break
+				}
+				path = append(path, string(s))
+			}
+			paths[path.String()] = path
+			return false
+		})
+
+		for dep := range c.Graph.Dependencies(rule) {
+			if r, ok := dep.(*ast.Rule); ok {
+				queue = append(queue, r)
+			}
+		}
+	}
+
+	var result []inputPath
+	for _, path := range paths {
+		result = append(result, path)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].String() < result[j].String() })
+	return result
+}
+
+// findUnknowns returns the paths to every unknown value in an input document. Paths stop at the first array, since
+// rules generally address array elements through variables rather than constant indices.
+func findUnknowns(doc any) []inputPath {
+	var paths []inputPath
+	var walk func(v any, path inputPath, inArray bool)
+	walk = func(v any, path inputPath, inArray bool) {
+		switch v := v.(type) {
+		case string:
+			if v == unknownValue {
+				paths = append(paths, append(inputPath(nil), path...))
+			}
+		case []any:
+			for _, e := range v {
+				walk(e, path, true)
+			}
+		case map[string]any:
+			for k, e := range v {
+				if inArray {
+					walk(e, path, true)
+				} else {
+					walk(e, append(path, k), false)
+				}
+			}
+		}
+	}
+	walk(doc, nil, false)
+
+	sort.Slice(paths, func(i, j int) bool { return paths[i].String() < paths[j].String() })
+	return paths
+}
+
+// readsUnknown returns the first unknown path that any of reads overlaps, if any.
+func readsUnknown(reads []inputPath, unknowns []inputPath) (inputPath, bool) {
+	for _, unknown := range unknowns {
+		for _, read := range reads {
+			if read.overlaps(unknown) {
+				return unknown, true
+			}
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,40 @@
+package aws
+
+import future.keywords.if
+import future.keywords.in
+
+# Resource Options: Production databases must be protected from deletion
+deny[msg] {
+    input.type == "aws:rds/instance:Instance"
+    contains(lower(input.__name), "prod")
+    not input.__options.protect
+    msg := sprintf("Production RDS instance '%s' must set the protect resource option", [input.__name])
+}
+
+# Resource Options: Tags must never be excluded from updates
+deny[msg] {
+    some path in input.__options.ignoreChanges
+    ignores_tags(path)
+    msg := sprintf("Resource '%s' must not ignore changes to tags ('%s')", [input.__name, path])
+}
+
+# Resource Options: Replacing production databases must not delete them first
+warn[msg] {
+    input.type == "aws:rds/instance:Instance"
+    contains(lower(input.__name), "prod")
+    input.__options.deleteBeforeReplace == true
+    msg := sprintf("Production RDS instance '%s' uses deleteBeforeReplace, which causes downtime on replacement", [input.__name])
+}
+
+# Helper: whether an ignoreChanges path covers the tags property
+ignores_tags(path) {
+    path == "tags"
+}
+
+ignores_tags(path) {
+    startswith(path, "tags.")
+}
+
+ignores_tags(path) {
+    startswith(path, "tags[")
+}
@@ -0,0 +1,22 @@
+package aws
+
+import future.keywords.if
+import future.keywords.in
+
+# Properties that hold credentials and must always be Pulumi secrets
+sensitive_fields := {
+    "password",
+    "masterPassword",
+    "secretString",
+    "secretKey",
+    "privateKey",
+    "token",
+}
+
+# Secrets: Credentials must not be stored in plaintext
+deny[msg] {
+    some field in sensitive_fields
+    input[field]
+    not field in input.__secrets
+    msg := sprintf("Resource '%s' stores '%s' in plaintext; mark it as a secret", [input.__name, field])
+}